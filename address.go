@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"strings"
+
+	"gitlab.com/moneropay/go-monero/walletrpc"
+	"golang.org/x/crypto/sha3"
+)
+
+// Kinds of Monero addresses
+const (
+	addressStandard   = "standard"
+	addressIntegrated = "integrated"
+	addressSubaddress = "subaddress"
+)
+
+// Monero networks
+const (
+	networkMainnet  = "mainnet"
+	networkTestnet  = "testnet"
+	networkStagenet = "stagenet"
+)
+
+type addressPrefix struct {
+	network string
+	kind    string
+}
+
+// Network byte of each network and address kind
+var addressPrefixes = map[uint64]addressPrefix{
+	18: {networkMainnet, addressStandard},
+	19: {networkMainnet, addressIntegrated},
+	42: {networkMainnet, addressSubaddress},
+	53: {networkTestnet, addressStandard},
+	54: {networkTestnet, addressIntegrated},
+	63: {networkTestnet, addressSubaddress},
+	24: {networkStagenet, addressStandard},
+	25: {networkStagenet, addressIntegrated},
+	36: {networkStagenet, addressSubaddress},
+}
+
+const (
+	standardAddressLen   = 95
+	integratedAddressLen = 106
+	paymentIdLen         = 8
+	addressChecksumLen   = 4
+)
+
+// Decoded Monero address
+type moneroAddress struct {
+	Address   string `json:"address"`
+	Network   string `json:"network"`
+	Kind      string `json:"kind"`
+	SpendKey  []byte `json:"-"`
+	ViewKey   []byte `json:"-"`
+	PaymentId []byte `json:"-"`
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// Monero's base58 encodes 8 byte blocks to 11 characters, a shorter last
+// block to as many characters as listed here by its size.
+var base58BlockLens = []int{0, 2, 3, 5, 6, 7, 9, 10, 11}
+
+const (
+	base58FullBlock    = 8
+	base58FullBlockLen = 11
+)
+
+// Decode Monero's blockwise base58.
+func base58Decode(s string) ([]byte, error) {
+	var out []byte
+	for len(s) > 0 {
+		n := min(len(s), base58FullBlockLen)
+		size := -1
+		for i, l := range base58BlockLens {
+			if l == n {
+				size = i
+			}
+		}
+		if size < 0 {
+			return nil, newProtocolError(codeAddressEncoding, "invalid base58 length")
+		}
+		var v uint64
+		for _, r := range s[:n] {
+			d := strings.IndexRune(base58Alphabet, r)
+			if d < 0 {
+				return nil, newProtocolError(codeAddressEncoding, "invalid character %q", r)
+			}
+			hi, lo := bits.Mul64(v, 58)
+			v = lo + uint64(d)
+			if hi != 0 || v < lo {
+				return nil, newProtocolError(codeAddressEncoding, "base58 block overflow")
+			}
+		}
+		if size < base58FullBlock && v>>(8*size) != 0 {
+			return nil, newProtocolError(codeAddressEncoding, "base58 block overflow")
+		}
+		var block [8]byte
+		binary.BigEndian.PutUint64(block[:], v)
+		out = append(out, block[8-size:]...)
+		s = s[n:]
+	}
+	return out, nil
+}
+
+// Encode bytes with Monero's blockwise base58.
+func base58Encode(b []byte) string {
+	var sb strings.Builder
+	for len(b) > 0 {
+		size := min(len(b), base58FullBlock)
+		var block [8]byte
+		copy(block[8-size:], b[:size])
+		v := binary.BigEndian.Uint64(block[:])
+		enc := make([]byte, base58BlockLens[size])
+		for i := len(enc) - 1; i >= 0; i-- {
+			enc[i] = base58Alphabet[v%58]
+			v /= 58
+		}
+		sb.Write(enc)
+		b = b[size:]
+	}
+	return sb.String()
+}
+
+func keccak256(data []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Decode and verify an address: its encoding, checksum, kind and that it
+// belongs to the configured network.
+func decodeAddress(s string) (*moneroAddress, error) {
+	if len(s) != standardAddressLen && len(s) != integratedAddressLen {
+		return nil, newProtocolError(codeInvalidAddress, "invalid address length %d", len(s))
+	}
+	raw, err := base58Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < addressChecksumLen {
+		return nil, newProtocolError(codeAddressEncoding, "address too short")
+	}
+	body, sum := raw[:len(raw)-addressChecksumLen], raw[len(raw)-addressChecksumLen:]
+	if !bytes.Equal(keccak256(body)[:addressChecksumLen], sum) {
+		return nil, newProtocolError(codeAddressChecksum, "address checksum mismatch")
+	}
+
+	tag, n := binary.Uvarint(body)
+	if n <= 0 {
+		return nil, newProtocolError(codeAddressEncoding, "invalid network byte")
+	}
+	prefix, ok := addressPrefixes[tag]
+	if !ok {
+		return nil, newProtocolError(codeUnknownAddressType, "unknown network byte %d", tag)
+	}
+	keys := body[n:]
+	want := 64
+	if prefix.kind == addressIntegrated {
+		want += paymentIdLen
+	}
+	if len(keys) != want {
+		return nil, newProtocolError(codeInvalidAddress, "%s address has %d bytes of keys", prefix.kind, len(keys))
+	}
+	if prefix.network != cfg.Mode {
+		return nil, newProtocolError(codeWrongNetwork, "%s address on %s", prefix.network, cfg.Mode)
+	}
+
+	a := &moneroAddress{
+		Address:  s,
+		Network:  prefix.network,
+		Kind:     prefix.kind,
+		SpendKey: keys[:32],
+		ViewKey:  keys[32:64],
+	}
+	if prefix.kind == addressIntegrated {
+		a.PaymentId = keys[64:]
+	}
+	return a, nil
+}
+
+// Payment ID of an integrated address in hex, as wallet-rpc shows it
+func (a *moneroAddress) paymentId() string {
+	return hex.EncodeToString(a.PaymentId)
+}
+
+// Encode keys and an optional payment ID as an address of a kind.
+func (a *moneroAddress) encode(kind string, paymentId []byte) string {
+	var tag uint64
+	for t, p := range addressPrefixes {
+		if p.network == a.Network && p.kind == kind {
+			tag = t
+		}
+	}
+	body := binary.AppendUvarint(nil, tag)
+	body = append(body, a.SpendKey...)
+	body = append(body, a.ViewKey...)
+	body = append(body, paymentId...)
+	body = append(body, keccak256(body)[:addressChecksumLen]...)
+	return base58Encode(body)
+}
+
+// Standard address of the same keys. Wallets may list payouts to an
+// integrated address under it.
+func (a *moneroAddress) standard() string {
+	return a.encode(addressStandard, nil)
+}
+
+// Integrated address of a standard address and a short payment ID
+func (a *moneroAddress) integrate(paymentId []byte) *moneroAddress {
+	return &moneroAddress{
+		Address:   a.encode(addressIntegrated, paymentId),
+		Network:   a.Network,
+		Kind:      addressIntegrated,
+		SpendKey:  a.SpendKey,
+		ViewKey:   a.ViewKey,
+		PaymentId: paymentId,
+	}
+}
+
+// Whether a wallet transfer destination is the given address. A payout to
+// an integrated address may be listed as its standard address with the
+// payment ID on the transfer.
+func sameDestination(address string, d walletrpc.Destination, paymentId string) bool {
+	if d.Address == address {
+		return true
+	}
+	a, err := decodeAddress(address)
+	if err != nil || a.Kind != addressIntegrated {
+		return false
+	}
+	return d.Address == a.standard() && paymentId == a.paymentId()
+}
+
+// Addresses the ATM can pay out to
+func addressValidator(s string) (*moneroAddress, error) {
+	return decodeAddress(s)
+}
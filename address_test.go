@@ -0,0 +1,220 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gitlab.com/moneropay/go-monero/walletrpc"
+)
+
+// Published example addresses
+const (
+	testSubaddress         = "888tNkZrPN6JsEgekjMnABU4TBzc2Dt29EPAvkRxbANsAnjyPbb3iQ1YBRk1UXcdRsiKc9dhwMVgN5S9cQUiyoogDavup3H"
+	testIntegratedAddress  = "4LL9oSLmtpccfufTMvppY6JwXNouMBzSkbLYfpAV5Usx3skxNgYeYTRj5UzqtReoS44qo9mtmXCqY45DJ852K5Jv2bYXZKKQePHES9khPK"
+	testStagenetAddress    = "55LTR8KniP4LQGJSPtbYDacR7dz8RBFnsfAKMaMuwUNYX6aQbBcovzDPyrQF9KXF9tVU6Xk3K8no1BywnJX6GvZX8yJsXvt"
+	testStagenetSubaddress = "73a4nWuvkYoYoksGurDjKZQcZkmaxLaKbbeiKzHnMmqKivrCzq5Q2JtJG1UZNZFqLPbQ3MiXCk2Q5bdwdUNSr7X9QrPubkn"
+)
+
+// Address with the character at i replaced
+func withChar(s string, i int, c byte) string {
+	return s[:i] + string(c) + s[i+1:]
+}
+
+func TestDecodeAddress(t *testing.T) {
+	t.Cleanup(func() { cfg.Mode = networkMainnet })
+	// A character inside a full block, so only the checksum notices
+	mistyped := withChar(testAddress, 50, testAddress[50]^1)
+	for _, tc := range []struct {
+		name    string
+		mode    string
+		address string
+		kind    string
+		code    string
+	}{
+		{"mainnet", networkMainnet, testAddress, addressStandard, ""},
+		{"mainnet_subaddress", networkMainnet, testSubaddress, addressSubaddress, ""},
+		{"mainnet_integrated", networkMainnet, testIntegratedAddress, addressIntegrated, ""},
+		{"stagenet", networkStagenet, testStagenetAddress, addressStandard, ""},
+		{"stagenet_subaddress", networkStagenet, testStagenetSubaddress, addressSubaddress, ""},
+		{"stagenet_on_mainnet", networkMainnet, testStagenetAddress, "", codeWrongNetwork},
+		{"mainnet_on_stagenet", networkStagenet, testAddress, "", codeWrongNetwork},
+		{"integrated_on_testnet", networkTestnet, testIntegratedAddress, "", codeWrongNetwork},
+		{"bad_checksum", networkMainnet, mistyped, "", codeAddressChecksum},
+		{"bad_character", networkMainnet, withChar(testAddress, 50, '0'), "", codeAddressEncoding},
+		{"too_short", networkMainnet, testAddress[:94], "", codeInvalidAddress},
+		{"too_long", networkMainnet, testAddress + "1", "", codeInvalidAddress},
+		{"empty", networkMainnet, "", "", codeInvalidAddress},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg.Mode = tc.mode
+			a, err := decodeAddress(tc.address)
+			if tc.code != "" {
+				if code := errorCode(err); code != tc.code {
+					t.Fatalf("expected %s, got %v", tc.code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Kind != tc.kind || a.Network != tc.mode {
+				t.Errorf("got %s %s, want %s %s", a.Network, a.Kind, tc.mode, tc.kind)
+			}
+			if enc := base58Encode(mustBase58(t, tc.address)); enc != tc.address {
+				t.Errorf("base58 round trip gave %s", enc)
+			}
+		})
+	}
+}
+
+func mustBase58(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base58Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestIntegratedAddress(t *testing.T) {
+	cfg.Mode = networkMainnet
+	a, err := decodeAddress(testIntegratedAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.PaymentId) != paymentIdLen {
+		t.Fatalf("payment ID of %d bytes", len(a.PaymentId))
+	}
+	std, err := decodeAddress(a.standard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if std.Kind != addressStandard {
+		t.Fatalf("standard address is %s", std.Kind)
+	}
+	if again := std.integrate(a.PaymentId); again.Address != testIntegratedAddress {
+		t.Errorf("integrating the standard address gave %s", again.Address)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		dest      string
+		paymentId string
+		want      bool
+	}{
+		{"same", testIntegratedAddress, "", true},
+		{"standard_with_payment_id", a.standard(), a.paymentId(), true},
+		{"standard_without_payment_id", a.standard(), "", false},
+		{"other_payment_id", a.standard(), "0000000000000000", false},
+		{"other_address", testAddress, a.paymentId(), false},
+	} {
+		got := sameDestination(testIntegratedAddress, walletrpc.Destination{Address: tc.dest}, tc.paymentId)
+		if got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	d := newAddressDetails(a, &moneroUri{Address: a.Address}, nil)
+	if !d.NeedsConfirmation || d.PaymentId != a.paymentId() {
+		t.Errorf("integrated address details %+v", d)
+	}
+}
+
+func TestParseMoneroUri(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		uri  string
+		want moneroUri
+		// Expected error code, empty when the URI parses
+		code string
+	}{
+		{name: "bare", uri: " " + testAddress + "\n", want: moneroUri{Address: testAddress}},
+		{name: "plain", uri: "monero:" + testAddress, want: moneroUri{Address: testAddress}},
+		{name: "slashes", uri: "monero://" + testAddress, want: moneroUri{Address: testAddress}},
+		{name: "uppercase_scheme", uri: "MONERO:" + testAddress, want: moneroUri{Address: testAddress}},
+		{name: "parameters", uri: "monero:" + testAddress +
+			"?tx_amount=1.5&tx_payment_id=ABCDEF0123456789&recipient_name=Monero%20Fund&tx_description=Donation&foo=bar",
+			want: moneroUri{Address: testAddress, Amount: 1500000000000, PaymentId: "abcdef0123456789",
+				RecipientName: "Monero Fund", Description: "Donation"}},
+		{name: "smallest_amount", uri: "monero:" + testAddress + "?tx_amount=0.000000000001",
+			want: moneroUri{Address: testAddress, Amount: 1}},
+		{name: "other_scheme", uri: "bitcoin:" + testAddress, code: codeInvalidUri},
+		{name: "several_recipients", uri: "monero:" + testAddress + ";" + testSubaddress, code: codeInvalidUri},
+		{name: "repeated", uri: "monero:" + testAddress + "?tx_amount=1&tx_amount=2", code: codeInvalidUri},
+		{name: "malformed_query", uri: "monero:" + testAddress + "?tx_amount=%zz", code: codeInvalidUri},
+		{name: "amount_not_a_number", uri: "monero:" + testAddress + "?tx_amount=abc", code: codeInvalidUri},
+		{name: "amount_two_points", uri: "monero:" + testAddress + "?tx_amount=1.2.3", code: codeInvalidUri},
+		{name: "amount_negative", uri: "monero:" + testAddress + "?tx_amount=-1", code: codeInvalidUri},
+		{name: "amount_zero", uri: "monero:" + testAddress + "?tx_amount=0", code: codeInvalidUri},
+		{name: "amount_empty", uri: "monero:" + testAddress + "?tx_amount=", code: codeInvalidUri},
+		{name: "amount_too_precise", uri: "monero:" + testAddress + "?tx_amount=0." + strings.Repeat("1", 13),
+			code: codeInvalidUri},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := parseMoneroUri(tc.uri)
+			if tc.code != "" {
+				if code := errorCode(err); code != tc.code {
+					t.Fatalf("expected %s, got %v", tc.code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *u != tc.want {
+				t.Errorf("got %+v, want %+v", *u, tc.want)
+			}
+		})
+	}
+}
+
+func TestUriDestination(t *testing.T) {
+	cfg.Mode = networkMainnet
+	integrated, err := decodeAddress(testIntegratedAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		uri       moneroUri
+		kind      string
+		paymentId string
+		code      string
+	}{
+		{name: "standard", uri: moneroUri{Address: testAddress}, kind: addressStandard},
+		{name: "integrated", uri: moneroUri{Address: testIntegratedAddress}, kind: addressIntegrated,
+			paymentId: integrated.paymentId()},
+		{name: "short_payment_id", uri: moneroUri{Address: integrated.standard(), PaymentId: integrated.paymentId()},
+			kind: addressIntegrated, paymentId: integrated.paymentId()},
+		{name: "long_payment_id", uri: moneroUri{Address: testAddress, PaymentId: strings.Repeat("ab", 32)},
+			code: codeInvalidUri},
+		{name: "odd_payment_id", uri: moneroUri{Address: testAddress, PaymentId: "abc"}, code: codeInvalidUri},
+		{name: "payment_id_length", uri: moneroUri{Address: testAddress, PaymentId: "abcd"}, code: codeInvalidUri},
+		{name: "payment_id_on_subaddress", uri: moneroUri{Address: testSubaddress, PaymentId: "0123456789abcdef"},
+			code: codeInvalidUri},
+		{name: "payment_id_on_integrated", uri: moneroUri{Address: testIntegratedAddress, PaymentId: "0123456789abcdef"},
+			code: codeInvalidUri},
+		{name: "wrong_network", uri: moneroUri{Address: testStagenetAddress}, code: codeWrongNetwork},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := tc.uri
+			a, err := u.destination()
+			if tc.code != "" {
+				if code := errorCode(err); code != tc.code {
+					t.Fatalf("expected %s, got %v", tc.code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Kind != tc.kind || a.paymentId() != tc.paymentId {
+				t.Errorf("got %s with payment ID %q, want %s with %q", a.Kind, a.paymentId(), tc.kind, tc.paymentId)
+			}
+		})
+	}
+	if a, _ := (&moneroUri{Address: integrated.standard(), PaymentId: integrated.paymentId()}).destination(); a == nil ||
+		a.Address != testIntegratedAddress {
+		t.Error("payment ID isn't folded into the published integrated address")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monero-atm/pricefetcher"
+)
+
+// Price sources of pricefetcher
+const (
+	sourceKraken        = "kraken"
+	sourceCoinGecko     = "coingecko"
+	sourceCryptoCompare = "cryptocompare"
+	// Quotes USDT, used as USD
+	sourceBinance = "binance"
+)
+
+// What a single source said about an XMR pair
+type sourcePrice struct {
+	Source string  `json:"source"`
+	Price  float64 `json:"price,omitempty"`
+	Error  string  `json:"error,omitempty"`
+	// Within the allowed deviation and part of the median
+	Used      bool      `json:"used"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// Aggregated XMR or BTC price in one currency and how it came about
+type aggregatePrice struct {
+	// XMR, or BTC for the second leg of the btc path
+	Base      string        `json:"base"`
+	Currency  string        `json:"currency"`
+	Price     float64       `json:"price"`
+	Sources   []sourcePrice `json:"sources"`
+	FetchedAt time.Time     `json:"fetched_at"`
+}
+
+func fetchFromSource(fetcher *pricefetcher.Client, source, currency string) (float64, error) {
+	switch source {
+	case sourceKraken:
+		return fetcher.FetchFromKraken(currency)
+	case sourceCoinGecko:
+		return fetcher.FetchFromCoinGecko(currency)
+	case sourceCryptoCompare:
+		return fetcher.FetchFromCryptoCompare(currency)
+	case sourceBinance:
+		if currency != "USD" {
+			return 0, fmt.Errorf("binance only quotes USDT")
+		}
+		return fetcher.FetchFromBinance()
+	}
+	return 0, fmt.Errorf("unknown price source %q", source)
+}
+
+func median(prices []float64) float64 {
+	sorted := append([]float64(nil), prices...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Query every configured source at once and take the median of those that
+// agree. Sources deviating from the median of all answers by more than the
+// allowed fraction are discarded.
+func fetchAggregate(fetcher *pricefetcher.Client, cl *http.Client, base, currency string) (aggregatePrice, error) {
+	ap := aggregatePrice{Base: base, Currency: currency, Sources: make([]sourcePrice, len(cfg.PriceSources))}
+	var wg sync.WaitGroup
+	for i, source := range cfg.PriceSources {
+		wg.Add(1)
+		go func(i int, source string) {
+			defer wg.Done()
+			sp := sourcePrice{Source: source}
+			var price float64
+			var err error
+			if base == "BTC" {
+				price, err = fetchBtcFromSource(cl, source, currency)
+			} else {
+				price, err = fetchFromSource(fetcher, source, currency)
+			}
+			sp.FetchedAt = time.Now()
+			if err == nil && price <= 0 {
+				err = fmt.Errorf("non-positive price")
+			}
+			if err != nil {
+				sp.Error = err.Error()
+			} else {
+				sp.Price = price
+			}
+			ap.Sources[i] = sp
+		}(i, source)
+	}
+	wg.Wait()
+
+	var all []float64
+	for _, sp := range ap.Sources {
+		if sp.Error == "" {
+			all = append(all, sp.Price)
+		}
+	}
+	if len(all) == 0 {
+		return ap, fmt.Errorf("no source has a %s/%s price", base, currency)
+	}
+	mid := median(all)
+
+	var agreeing []float64
+	var used []string
+	for i, sp := range ap.Sources {
+		if sp.Error != "" {
+			continue
+		}
+		deviation := sp.Price/mid - 1
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		if cfg.PriceMaxDeviation > 0 && deviation > cfg.PriceMaxDeviation {
+			ap.Sources[i].Error = fmt.Sprintf("deviates %.2f%% from the median", deviation*100)
+			continue
+		}
+		ap.Sources[i].Used = true
+		agreeing = append(agreeing, sp.Price)
+		used = append(used, sp.Source)
+		if ap.FetchedAt.IsZero() || sp.FetchedAt.Before(ap.FetchedAt) {
+			ap.FetchedAt = sp.FetchedAt
+		}
+	}
+	if len(agreeing) < cfg.PriceMinSources {
+		return ap, fmt.Errorf("only %d sources agree on %s/%s (%s), %d needed",
+			len(agreeing), base, currency, strings.Join(used, ", "), cfg.PriceMinSources)
+	}
+	ap.Price = median(agreeing)
+	return ap, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Answers requests with canned bodies by host, so the price sources can be
+// tested offline.
+type cannedTransport map[string]string
+
+func (ct cannedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, ok := ct[r.URL.Host]
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusNotFound
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Header:     make(http.Header),
+		Request:    r,
+	}, nil
+}
+
+func TestBtcAggregate(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.PriceSources = []string{sourceKraken, sourceCoinGecko, sourceCryptoCompare}
+	cfg.PriceMaxDeviation = 0.02
+	cfg.PriceMinSources = 2
+	cl := &http.Client{Transport: cannedTransport{
+		"api.kraken.com":            `{"error": [], "result": {"XXBTZEUR": {"c": ["60000.0", "0.1"]}}}`,
+		"api.coingecko.com":         `{"bitcoin": {"eur": 60300}}`,
+		"min-api.cryptocompare.com": `{"EUR": 70000}`,
+	}}
+
+	ap, err := fetchAggregate(nil, cl, "BTC", "EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap.Base != "BTC" || ap.Price != 60150 {
+		t.Errorf("got %s price %v, want BTC 60150", ap.Base, ap.Price)
+	}
+	if ap.Sources[2].Used {
+		t.Error("deviating source is used")
+	}
+
+	// One source left isn't enough.
+	cl.Transport = cannedTransport{"api.coingecko.com": `{"bitcoin": {"eur": 60300}}`}
+	if _, err := fetchAggregate(nil, cl, "BTC", "EUR"); err == nil {
+		t.Error("a single source was accepted")
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+// Kinds of audit records. The audit log uses the journal's format but is
+// never replayed, it's for the operator and regulators.
+const (
+	auditLimit     = "limit"
+	auditScreening = "screening"
+)
+
+// Audit log, see the audit_log option
+var auditLog *journal
+
+// Which check a limit decision was made for
+const (
+	limitCheckNote    = "note"
+	limitCheckAddress = "address"
+	limitCheckPayout  = "payout"
+)
+
+type auditLimitData struct {
+	Kiosk    string      `json:"kiosk,omitempty"`
+	Check    string      `json:"check"`
+	Address  string      `json:"address,omitempty"`
+	Currency string      `json:"currency"`
+	Amount   int64       `json:"amount"`
+	Allowed  bool        `json:"allowed"`
+	Limit    *limitState `json:"limit,omitempty"`
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"time"
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/rs/zerolog/log"
+	"gitlab.com/openkiosk/proto"
 )
 
 func onConnectionUp(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
@@ -48,7 +49,7 @@ func connectToBroker() *autopaho.ConnectionManager {
 				func(pr paho.PublishReceived) (bool, error) {
 					log.Debug().Str("topic", pr.Packet.Topic).
 						Str("payload", string(pr.Packet.Payload)).Msg("")
-					handleEvents(pr.Packet.Payload)
+					handleEvents(pr.Packet.Topic, pr.Packet.Payload)
 					return true, nil
 				},
 			},
@@ -66,6 +67,25 @@ func connectToBroker() *autopaho.ConnectionManager {
 }
 
 func cmd(broker *autopaho.ConnectionManager, topic, cmd string) {
+	cmdData(broker, topic, cmd, nil)
+}
+
+// Send a command with data to a component.
+func cmdData(broker *autopaho.ConnectionManager, topic, cmd string, data interface{}) {
+	c := proto.Cmd{Cmd: cmd}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to marshal command data")
+			return
+		}
+		c.Data = b
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal command")
+		return
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := broker.AwaitConnection(ctx); err != nil { // Should only happen when context is cancelled
@@ -76,7 +96,7 @@ func cmd(broker *autopaho.ConnectionManager, topic, cmd string) {
 	pr, err := broker.Publish(context.Background(), &paho.Publish{
 		QoS:     2,
 		Topic:   topic,
-		Payload: []byte(fmt.Sprintf(`{"cmd": "%s"}`, cmd)),
+		Payload: payload,
 	})
 	if err != nil {
 		log.Error().Err(err).Msg("Error publishing.")
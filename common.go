@@ -5,12 +5,32 @@ import (
 	"time"
 )
 
-func sendToFrontend(u update) error {
+// Send an update from within appLogic. Replies to a frontend message carry
+// its ID.
+func (s *sessionData) sendToFrontend(u update) error {
+	if u.Id == "" {
+		u.Id = s.replyTo
+	}
+	return s.enqueue(u)
+}
+
+// Queue an update for the frontend. Safe to call from any goroutine.
+func (s *sessionData) enqueue(u update) error {
 	u.Timestamp = time.Now()
 	updateBytes, err := json.Marshal(u)
 	if err != nil {
 		return err
 	}
-	outgoing <- updateBytes
+	s.out.push(updateBytes, u.Event == eventPrice || u.Event == eventMpayHealth)
 	return nil
 }
+
+// Replace whatever is pending in a single-slot channel with v. Must only be
+// used by the sole sender of the channel.
+func offer[T any](ch chan T, v T) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- v
+}
@@ -4,12 +4,13 @@ import (
 	"log"
 	"net/url"
 	"os"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
+	"gitlab.com/monero-atm/atm-backend/money"
 	"gopkg.in/yaml.v3"
 )
 
@@ -22,20 +23,71 @@ type brokerConfig struct {
 }
 
 type backendConfig struct {
-	Mqtt               brokerConfig  `yaml:"mqtt"`
-	Mode               string        `yaml:"mode"`
-	LogFormat          string        `yaml:"log_format"`
-	LogFile            string        `yaml:"log_file"`
-	Fee                float64       `yaml:"fee"`
-	Moneropay          string        `yaml:"moneropay"`
-	MpayTimeout        time.Duration `yaml:"moneropay_timeout"`
-	MpayHealthPollFreq time.Duration `yaml:"moneropay_health_poll_frequency"`
-	PricePollFreq      time.Duration `yaml:"price_poll_frequency"`
-	Currencies         []string      `yaml:"currencies"`
-	FallbackPrice      float64       `yaml:"fallback_price"`
-	FiatRates          map[string]float64
-	Bind               string        `yaml:"bind"`
-	PriceNotifyFreq    time.Duration `yaml:"price_notification_frequency"`
+	Mqtt                   brokerConfig             `yaml:"mqtt"`
+	Mode                   string                   `yaml:"mode"`
+	ConfirmAddresses       bool                     `yaml:"confirm_addresses"`
+	UriTargetAmount        bool                     `yaml:"uri_target_amount"`
+	OpenAliasResolver      string                   `yaml:"openalias_resolver"`
+	OpenAliasTimeout       time.Duration            `yaml:"openalias_timeout"`
+	OpenAliasRequireDnssec bool                     `yaml:"openalias_require_dnssec"`
+	AddressList            string                   `yaml:"address_list"`
+	AddressListMode        string                   `yaml:"address_list_mode"`
+	AddressListAction      string                   `yaml:"address_list_action"`
+	AddressListReload      time.Duration            `yaml:"address_list_reload"`
+	LogFormat              string                   `yaml:"log_format"`
+	LogFile                string                   `yaml:"log_file"`
+	Fee                    float64                  `yaml:"fee"`
+	Moneropay              string                   `yaml:"moneropay"`
+	MpayTimeout            time.Duration            `yaml:"moneropay_timeout"`
+	MpayHealthPollFreq     time.Duration            `yaml:"moneropay_health_poll_frequency"`
+	PricePollFreq          time.Duration            `yaml:"price_poll_frequency"`
+	Currencies             []string                 `yaml:"currencies"`
+	FallbackRate           float64                  `yaml:"fallback_rate"`
+	FallbackRates          map[string]float64       `yaml:"fallback_rates"`
+	PriceCacheMaxAge       time.Duration            `yaml:"price_cache_max_age"`
+	FallbackMaxAge         time.Duration            `yaml:"fallback_max_age"`
+	FiatRateCache          string                   `yaml:"fiat_rate_cache"`
+	FiatRateRetry          time.Duration            `yaml:"fiat_rate_retry"`
+	FiatRateMaxAge         time.Duration            `yaml:"fiat_rate_max_age"`
+	FiatRateProviders      []fiatRateProviderConfig `yaml:"fiat_rate_providers"`
+	FiatRateRefresh        time.Duration            `yaml:"fiat_rate_refresh"`
+	FiatRateMaxDivergence  float64                  `yaml:"fiat_rate_max_divergence"`
+	PricePaths             map[string]string        `yaml:"price_paths"`
+	Bind                   string                   `yaml:"bind"`
+	PriceNotifyFreq        time.Duration            `yaml:"price_notification_frequency"`
+	Journal                string                   `yaml:"journal"`
+	JournalResumeMaxAge    time.Duration            `yaml:"journal_resume_max_age"`
+	WalletRpc              string                   `yaml:"wallet_rpc"`
+	PayoutSettleTime       time.Duration            `yaml:"payout_settle_time"`
+	Kiosks                 []string                 `yaml:"kiosks"`
+	TlsCert                string                   `yaml:"tls_cert"`
+	TlsKey                 string                   `yaml:"tls_key"`
+	TlsClientCa            string                   `yaml:"tls_client_ca"`
+	DuplicateWindow        time.Duration            `yaml:"duplicate_window"`
+	QuoteTtl               time.Duration            `yaml:"quote_ttl"`
+	QuoteExpiryPolicy      string                   `yaml:"quote_expiry_policy"`
+	RoundingName           string                   `yaml:"rounding"`
+	MoneyinMinorUnits      bool                     `yaml:"moneyin_minor_units"`
+	CurrencyPolicy         string                   `yaml:"currency_policy"`
+	Limits                 limitsConfig             `yaml:"limits"`
+	Ledger                 string                   `yaml:"ledger"`
+	AuditLog               string                   `yaml:"audit_log"`
+	MinFiat                map[string]float64       `yaml:"min_fiat"`
+	MinPayoutXmr           string                   `yaml:"min_payout"`
+	NetworkFeePolicy       string                   `yaml:"network_fee"`
+	Fees                   feesConfig               `yaml:"fees"`
+	PriceSources           []string                 `yaml:"price_sources"`
+	PriceMaxDeviation      float64                  `yaml:"price_max_deviation"`
+	PriceMinSources        int                      `yaml:"price_min_sources"`
+	PriceMaxAge            time.Duration            `yaml:"price_max_age"`
+	NetworkFeeFallbackXmr  string                   `yaml:"network_fee_fallback"`
+	// Derived from the options above
+	Rounding money.Rounding `yaml:"-"`
+	// Piconero
+	MinPayout          uint64 `yaml:"-"`
+	NetworkFeeFallback uint64 `yaml:"-"`
+	// Minor units
+	minFiat map[string]int64
 }
 
 func loadConfig() backendConfig {
@@ -51,6 +103,203 @@ func loadConfig() backendConfig {
 		log.Fatal("Failed to unmarshal yaml: ", err)
 	}
 
+	if cfg.Journal == "" {
+		cfg.Journal = "journal.log"
+	}
+	if cfg.Ledger == "" {
+		cfg.Ledger = "ledger.log"
+	}
+	if cfg.AuditLog == "" {
+		cfg.AuditLog = "audit.log"
+	}
+	// Declaring an uncertain payout failed too soon risks paying twice.
+	if cfg.PayoutSettleTime == 0 {
+		cfg.PayoutSettleTime = 5 * time.Minute
+	}
+	if cfg.PayoutSettleTime < 0 {
+		log.Fatal("payout_settle_time must be positive")
+	}
+	if cfg.FiatRateCache == "" {
+		cfg.FiatRateCache = "fiat_rates.json"
+	}
+	if cfg.FiatRateRetry == 0 {
+		cfg.FiatRateRetry = 10 * time.Minute
+	}
+	if cfg.FiatRateRefresh == 0 {
+		cfg.FiatRateRefresh = time.Hour
+	}
+	if len(cfg.FiatRateProviders) == 0 {
+		cfg.FiatRateProviders = []fiatRateProviderConfig{{Type: "ecb"}}
+	}
+	names := make(map[string]bool)
+	for _, pc := range cfg.FiatRateProviders {
+		p, err := newFiatRateProvider(pc)
+		if err != nil {
+			log.Fatal("Invalid fiat rate provider: ", err)
+		}
+		if names[p.name()] {
+			log.Fatalf("Duplicate fiat rate provider %q", p.name())
+		}
+		names[p.name()] = true
+		fiatRates.providers = append(fiatRates.providers, p)
+	}
+	if cfg.FiatRateMaxAge == 0 {
+		// Covers weekends and holidays
+		cfg.FiatRateMaxAge = 96 * time.Hour
+	}
+
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = networkMainnet
+	case networkMainnet, networkTestnet, networkStagenet:
+	default:
+		log.Fatalf("Unknown mode %q", cfg.Mode)
+	}
+
+	if cfg.OpenAliasTimeout == 0 {
+		cfg.OpenAliasTimeout = 5 * time.Second
+	}
+
+	switch cfg.AddressListMode {
+	case "":
+		cfg.AddressListMode = screeningDeny
+	case screeningDeny, screeningAllow:
+	default:
+		log.Fatalf("Unknown address_list_mode %q", cfg.AddressListMode)
+	}
+	switch cfg.AddressListAction {
+	case "":
+		cfg.AddressListAction = screeningReject
+	case screeningReject, screeningWarn:
+	default:
+		log.Fatalf("Unknown address_list_action %q", cfg.AddressListAction)
+	}
+	if cfg.AddressListReload == 0 {
+		cfg.AddressListReload = 10 * time.Second
+	}
+
+	if cfg.QuoteTtl == 0 {
+		cfg.QuoteTtl = 10 * time.Minute
+	}
+	if cfg.QuoteTtl < 0 {
+		log.Fatal("quote_ttl must be positive")
+	}
+	switch cfg.QuoteExpiryPolicy {
+	case "":
+		cfg.QuoteExpiryPolicy = quoteRequote
+	case quoteRequote, quoteHonor, quoteConfirm:
+	default:
+		log.Fatalf("Unknown quote_expiry_policy %q", cfg.QuoteExpiryPolicy)
+	}
+
+	for i, c := range cfg.Currencies {
+		cfg.Currencies[i] = strings.ToUpper(c)
+	}
+	if err := validateCurrencies(cfg.Currencies); err != nil {
+		log.Fatal("Invalid currencies: ", err)
+	}
+
+	cfg.Limits.minor = map[string]map[string]int64{}
+	for scope, limits := range map[string]map[string]float64{
+		limitSession: cfg.Limits.Session,
+		limitDaily:   cfg.Limits.Daily,
+		limitMonthly: cfg.Limits.Monthly,
+	} {
+		cfg.Limits.minor[scope] = make(map[string]int64)
+		for c, v := range limits {
+			c = strings.ToUpper(c)
+			if _, ok := currencyExponents[c]; !ok {
+				log.Fatalf("Unknown currency %q in %s limits", c, scope)
+			}
+			cfg.Limits.minor[scope][c] = majorToMinor(c, v)
+		}
+	}
+	cfg.Limits.largestNote = make(map[string]int64)
+	for c, v := range cfg.Limits.LargestNote {
+		c = strings.ToUpper(c)
+		if _, ok := currencyExponents[c]; !ok {
+			log.Fatalf("Unknown currency %q in largest_note", c)
+		}
+		cfg.Limits.largestNote[c] = majorToMinor(c, v)
+	}
+
+	cfg.minFiat = make(map[string]int64)
+	for c, v := range cfg.MinFiat {
+		c = strings.ToUpper(c)
+		if _, ok := currencyExponents[c]; !ok {
+			log.Fatalf("Unknown currency %q in min_fiat", c)
+		}
+		cfg.minFiat[c] = majorToMinor(c, v)
+	}
+	if cfg.MinPayoutXmr != "" {
+		if cfg.MinPayout, err = money.ParseXmr(cfg.MinPayoutXmr); err != nil {
+			log.Fatal("Failed to parse min_payout: ", err)
+		}
+	}
+
+	pricePaths := make(map[string]string)
+	for c, p := range cfg.PricePaths {
+		switch p {
+		case pathDirect, pathEur, pathUsd, pathBtc:
+		default:
+			log.Fatalf("Unknown price path %q for %s", p, c)
+		}
+		pricePaths[strings.ToUpper(c)] = p
+	}
+	cfg.PricePaths = pricePaths
+
+	if len(cfg.PriceSources) == 0 {
+		cfg.PriceSources = []string{sourceKraken, sourceCoinGecko, sourceCryptoCompare}
+	}
+	for _, source := range cfg.PriceSources {
+		switch source {
+		case sourceKraken, sourceCoinGecko, sourceCryptoCompare, sourceBinance:
+		default:
+			log.Fatalf("Unknown price source %q", source)
+		}
+	}
+	fallbackRates := make(map[string]float64)
+	for c, v := range cfg.FallbackRates {
+		fallbackRates[strings.ToUpper(c)] = v
+	}
+	cfg.FallbackRates = fallbackRates
+	if (cfg.FallbackRate > 0 || len(cfg.FallbackRates) > 0) && cfg.FallbackMaxAge <= 0 {
+		log.Fatal("fallback_max_age must be set to use fallback rates")
+	}
+	if cfg.PriceMinSources < 1 {
+		cfg.PriceMinSources = 1
+	}
+
+	if err := cfg.Fees.prepare(cfg.Fee); err != nil {
+		log.Fatal("Invalid fees: ", err)
+	}
+
+	switch cfg.NetworkFeePolicy {
+	case "":
+		cfg.NetworkFeePolicy = networkFeeAbsorb
+	case networkFeeAbsorb, networkFeeDeduct:
+	default:
+		log.Fatalf("Unknown network_fee %q", cfg.NetworkFeePolicy)
+	}
+	if cfg.NetworkFeeFallbackXmr != "" {
+		if cfg.NetworkFeeFallback, err = money.ParseXmr(cfg.NetworkFeeFallbackXmr); err != nil {
+			log.Fatal("Failed to parse network_fee_fallback: ", err)
+		}
+	}
+
+	switch cfg.CurrencyPolicy {
+	case "":
+		cfg.CurrencyPolicy = currencySingle
+	case currencySingle, currencyMixed:
+	default:
+		log.Fatalf("Unknown currency_policy %q", cfg.CurrencyPolicy)
+	}
+
+	cfg.Rounding, err = money.ParseRounding(cfg.RoundingName)
+	if err != nil {
+		log.Fatal("Failed to parse rounding: ", err)
+	}
+
 	f, err := os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
 		panic(err)
@@ -69,27 +318,17 @@ func loadConfig() backendConfig {
 		cfg.Mqtt.BrokerUrls = append(cfg.Mqtt.BrokerUrls, u)
 	}
 
-	for _, topic := range cfg.Mqtt.Topics {
-		cfg.Mqtt.Subscriptions = append(cfg.Mqtt.Subscriptions, paho.SubscribeOptions{
-			Topic: topic, QoS: 2, NoLocal: true})
+	// A single kiosk without ID, using bare MQTT topics.
+	if len(cfg.Kiosks) == 0 {
+		cfg.Kiosks = []string{""}
 	}
-
-	rates, err := fetchEcbDaily()
-	if err != nil {
-		log.Fatalf("Failed to get fiat rates from ECB: %s", err.Error())
-	}
-	cfg.FiatRates = make(map[string]float64)
-	for _, c := range cfg.Currencies {
-		// XMR pairs are available for these currencies
-		if c == "EUR" || c == "USD" {
-			continue
+	for _, kiosk := range cfg.Kiosks {
+		if strings.Contains(kiosk, "/") {
+			log.Fatalf("Kiosk ID %q must not contain '/'", kiosk)
 		}
-		if val, ok := rates[c]; ok {
-			cRate, err := strconv.ParseFloat(val, 64)
-			cfg.FiatRates[c] = cRate
-			if err != nil {
-				log.Fatal("Failed to convert rate string into float64: ", err)
-			}
+		for _, topic := range cfg.Mqtt.Topics {
+			cfg.Mqtt.Subscriptions = append(cfg.Mqtt.Subscriptions, paho.SubscribeOptions{
+				Topic: kioskTopic(kiosk, topic), QoS: 2, NoLocal: true})
 		}
 	}
 
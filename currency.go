@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"gitlab.com/monero-atm/atm-backend/money"
+)
+
+// ISO 4217 exponents, the number of minor unit digits. Balances are kept in
+// minor units, e.g. cents.
+var currencyExponents = map[string]int{
+	"AUD": 2,
+	"BGN": 2,
+	"BRL": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"CZK": 2,
+	"DKK": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HKD": 2,
+	"HUF": 2,
+	"IDR": 2,
+	"ILS": 2,
+	"INR": 2,
+	"ISK": 0,
+	"JPY": 0,
+	"KRW": 0,
+	"MXN": 2,
+	"MYR": 2,
+	"NOK": 2,
+	"NZD": 2,
+	"PHP": 2,
+	"PLN": 2,
+	"RON": 2,
+	"SEK": 2,
+	"SGD": 2,
+	"THB": 2,
+	"TRY": 2,
+	"USD": 2,
+	"ZAR": 2,
+}
+
+// Whether a session may hold cash of several currencies
+const (
+	currencySingle = "single"
+	currencyMixed  = "mixed"
+)
+
+// Data of the moneyacceptord "currencies" command, limiting the notes it
+// accepts. Codes are lowercase like in its moneyin events.
+type acceptCurrenciesData struct {
+	Currencies []string `json:"currencies"`
+}
+
+// Cash inserted, in minor units, as sent to the frontend
+type moneyinData struct {
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"`
+	Exponent int    `json:"exponent"`
+	// Decimal amount for display, e.g. "12.50"
+	Display string `json:"display"`
+}
+
+// Hardware may send lowercase codes or none at all, in which case the note
+// is in the first configured currency.
+func normalizeCurrency(c string) string {
+	c = strings.ToUpper(strings.TrimSpace(c))
+	if c == "" && len(cfg.Currencies) > 0 {
+		return cfg.Currencies[0]
+	}
+	return c
+}
+
+func currencyExponent(c string) (int, error) {
+	exp, ok := currencyExponents[c]
+	if !ok {
+		return 0, newProtocolError(codeUnknownCurrency, "unknown currency %q", c)
+	}
+	return exp, nil
+}
+
+// Amount of a bill acceptor report in minor units. Acceptors report whole
+// units unless configured otherwise.
+func toMinorUnits(c string, amount int64) (int64, error) {
+	// Without a quoted price the note could never be paid out.
+	if !slices.Contains(cfg.Currencies, c) {
+		return 0, newProtocolError(codeUnknownCurrency, "currency %q isn't accepted", c)
+	}
+	return acceptorMinorUnits(c, amount)
+}
+
+// Convert an amount as the acceptor reports it to minor units, whether or
+// not the currency is accepted.
+func acceptorMinorUnits(c string, amount int64) (int64, error) {
+	exp, err := currencyExponent(c)
+	if err != nil {
+		return 0, err
+	}
+	if cfg.MoneyinMinorUnits {
+		return amount, nil
+	}
+	for i := 0; i < exp; i++ {
+		amount *= 10
+	}
+	return amount, nil
+}
+
+func fiat(c string, minor int64) money.Fiat {
+	return money.Fiat{Amount: minor, Exponent: currencyExponents[c]}
+}
+
+func formatFiat(c string, minor int64) string {
+	return fiat(c, minor).Rat().FloatString(currencyExponents[c])
+}
+
+func newMoneyinData(c string, minor int64) moneyinData {
+	return moneyinData{
+		Currency: c,
+		Amount:   minor,
+		Exponent: currencyExponents[c],
+		Display:  formatFiat(c, minor),
+	}
+}
+
+// Decimal balances for display
+func formatBalance(fiatBalance map[string]int64) map[string]string {
+	ret := make(map[string]string)
+	for c, v := range fiatBalance {
+		ret[c] = formatFiat(c, v)
+	}
+	return ret
+}
+
+// Refuse a note that would mix currencies when the policy doesn't allow it.
+func (s *sessionData) allowCurrency(c string) error {
+	if cfg.CurrencyPolicy == currencyMixed || !hasBalance(s.fiatBalance) {
+		return nil
+	}
+	if s.fiatBalance[c] == 0 {
+		return newProtocolError(codeCurrencyNotAllowed, "only one currency per transaction")
+	}
+	return nil
+}
+
+// Tell the bill acceptor which notes it may take. Once a session has cash
+// under the single currency policy, that's its currency. Currencies without
+// a price aren't taken. It's stopped when the limits of every currency are
+// used up.
+func (s *sessionData) restrictCurrencies() {
+	var allowed []string
+	for _, c := range cfg.Currencies {
+		if s.lastPrice != nil && slices.Contains(s.lastPrice.Missing, c) {
+			continue
+		}
+		if s.allowCurrency(c) == nil && s.limitAllows(c) {
+			allowed = append(allowed, strings.ToLower(c))
+		}
+	}
+	if len(allowed) == 0 {
+		s.cmd("moneyacceptord", "stop")
+		return
+	}
+	s.cmdData("moneyacceptord", "currencies", acceptCurrenciesData{Currencies: allowed})
+}
+
+// Convert a configured amount in whole units to minor units.
+func majorToMinor(c string, v float64) int64 {
+	return int64(math.Round(v * math.Pow10(currencyExponents[c])))
+}
+
+func validateCurrencies(currencies []string) error {
+	if len(currencies) == 0 {
+		return fmt.Errorf("no currencies configured")
+	}
+	for _, c := range currencies {
+		if _, ok := currencyExponents[c]; !ok {
+			return fmt.Errorf("unknown currency %q", c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestToMinorUnits(t *testing.T) {
+	cfg.Currencies = []string{"EUR", "JPY"}
+	cfg.MoneyinMinorUnits = false
+	for _, tc := range []struct {
+		currency string
+		amount   int64
+		want     int64
+		code     string
+	}{
+		{"EUR", 20, 2000, ""},
+		{"JPY", 1000, 1000, ""},
+		// Known exponent, but not configured so there's no price
+		{"USD", 20, 0, codeUnknownCurrency},
+		{"XXX", 20, 0, codeUnknownCurrency},
+	} {
+		got, err := toMinorUnits(tc.currency, tc.amount)
+		if tc.code != "" {
+			if errorCode(err) != tc.code {
+				t.Errorf("%s: expected %s, got %v", tc.currency, tc.code, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %d, %v, want %d", tc.currency, got, err, tc.want)
+		}
+	}
+}
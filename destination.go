@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"gitlab.com/monero-atm/atm-backend/money"
+	"gitlab.com/moneropay/go-monero/walletrpc"
+)
+
+// Scanned address as shown to the customer, also journaled with the address
+type addressDetails struct {
+	Address string `json:"address"`
+	Network string `json:"network"`
+	Kind    string `json:"kind"`
+	// Hex payment ID of an integrated address. Exchanges credit deposits by
+	// it, so the customer has to check it.
+	PaymentId string `json:"payment_id,omitempty"`
+	// From a monero: URI
+	RecipientName string `json:"recipient_name,omitempty"`
+	Description   string `json:"description,omitempty"`
+	// Requested amount in XMR
+	Amount    string         `json:"amount,omitempty"`
+	OpenAlias *openAliasInfo `json:"openalias,omitempty"`
+	// Screening warning, see address_flagged
+	Warning           string `json:"warning,omitempty"`
+	NeedsConfirmation bool   `json:"needs_confirmation"`
+	Confirmed         bool   `json:"confirmed"`
+}
+
+func newAddressDetails(a *moneroAddress, uri *moneroUri, flag *addressFlaggedData) *addressDetails {
+	d := &addressDetails{
+		Address:           a.Address,
+		Network:           a.Network,
+		Kind:              a.Kind,
+		RecipientName:     uri.RecipientName,
+		OpenAlias:         uri.OpenAlias,
+		Description:       uri.Description,
+		NeedsConfirmation: cfg.ConfirmAddresses,
+	}
+	if a.Kind == addressIntegrated {
+		d.PaymentId = a.paymentId()
+		d.NeedsConfirmation = true
+	}
+	if uri.Amount > 0 {
+		d.Amount = walletrpc.XMRToDecimal(uri.Amount)
+	}
+	// The customer should see whom they pay.
+	if d.RecipientName != "" || d.Description != "" || d.OpenAlias != nil {
+		d.NeedsConfirmation = true
+	}
+	if flag != nil {
+		d.Warning = flag.Reason
+		d.NeedsConfirmation = true
+	}
+	return d
+}
+
+// Make a validated address the session's destination.
+func (s *sessionData) setDestination(a *moneroAddress, uri *moneroUri, flag *addressFlaggedData) {
+	s.address = a.Address
+	s.destination = newAddressDetails(a, uri, flag)
+	journ.record(s.id, journalAddress, s.destination)
+}
+
+func (s *sessionData) confirmAddress() {
+	if s.destination == nil || s.destination.Confirmed {
+		return
+	}
+	s.destination.Confirmed = true
+	journ.record(s.id, journalAddressConfirmed, nil)
+	log.Info().Str("address", s.address).Msg("Customer confirmed address")
+}
+
+// Piconero the scanned URI asked for, zero without a target amount
+func (s *sessionData) target() uint64 {
+	if !cfg.UriTargetAmount || s.destination == nil || s.destination.Amount == "" {
+		return 0
+	}
+	amount, err := money.ParseXmr(s.destination.Amount)
+	if err != nil {
+		return 0
+	}
+	return amount
+}
+
+func hasConfirmedAddress(s *sessionData) error {
+	if err := hasAddress(s); err != nil {
+		return err
+	}
+	if d := s.destination; d != nil && d.NeedsConfirmation && !d.Confirmed {
+		return newProtocolError(codeAddressUnconfirmed, "address isn't confirmed")
+	}
+	return nil
+}
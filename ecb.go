@@ -2,21 +2,30 @@ package main
 
 import (
 	"encoding/xml"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 type ecbRates struct {
-	Rates []struct {
-		Currency string `xml:"currency,attr"`
-		Rate     string `xml:"rate,attr"`
-	} `xml:"Cube>Cube>Cube"`
+	Day struct {
+		Time  string `xml:"time,attr"`
+		Rates []struct {
+			Currency string `xml:"currency,attr"`
+			Rate     string `xml:"rate,attr"`
+		} `xml:"Cube"`
+	} `xml:"Cube>Cube"`
 }
 
 const ecbDailyUrl = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
 
+// ECB publishes around 16:00 CET on working days. A fixed zone is used, in
+// summer time this is an hour later, which is harmless.
+var ecbZone = time.FixedZone("CET", 3600)
+
 // Get daily conversion rates from ECB
-func fetchEcbDaily() (map[string]string, error) {
+func fetchEcbDaily(source string) (*fiatRateSet, error) {
 	req, err := http.NewRequest("GET", ecbDailyUrl, nil)
 	if err != nil {
 		return nil, err
@@ -33,9 +42,62 @@ func fetchEcbDaily() (map[string]string, error) {
 		return nil, err
 	}
 
-	mappedRates := make(map[string]string)
-	for _, r := range rates.Rates {
-		mappedRates[r.Currency] = r.Rate
+	set := &fiatRateSet{
+		Source:    source,
+		Date:      rates.Day.Time,
+		FetchedAt: time.Now(),
+		Rates:     make(map[string]float64),
+	}
+	for _, r := range rates.Day.Rates {
+		rate, err := strconv.ParseFloat(r.Rate, 64)
+		if err != nil {
+			return nil, fmt.Errorf("rate of %s: %w", r.Currency, err)
+		}
+		set.Rates[r.Currency] = rate
+	}
+	if len(set.Rates) == 0 {
+		return nil, fmt.Errorf("no rates in ECB response")
+	}
+	return set, nil
+}
+
+// Next time fresh rates should be out, a few minutes after publication on
+// the next working day.
+func nextEcbPublication(now time.Time) time.Time {
+	now = now.In(ecbZone)
+	next := time.Date(now.Year(), now.Month(), now.Day(), 16, 5, 0, 0, ecbZone)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	for next.Weekday() == time.Saturday || next.Weekday() == time.Sunday {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+type ecbProvider struct {
+	n string
+}
+
+func (p ecbProvider) name() string { return p.n }
+
+func (p ecbProvider) fetch() (*fiatRateSet, error) { return fetchEcbDaily(p.n) }
+
+// Right after the next publication, or a little later when today's rates
+// are late.
+func (ecbProvider) nextFetch(set *fiatRateSet, now time.Time) time.Time {
+	if ecbLate(set, now) {
+		return now.Add(cfg.FiatRateRetry)
+	}
+	return nextEcbPublication(now)
+}
+
+// Today's rates should be out but aren't, e.g. they're late or it's a
+// holiday.
+func ecbLate(set *fiatRateSet, now time.Time) bool {
+	now = now.In(ecbZone)
+	if now.Weekday() == time.Saturday || now.Weekday() == time.Sunday {
+		return false
 	}
-	return mappedRates, nil
+	return now.Hour() >= 16 && set.Date != now.Format(time.DateOnly)
 }
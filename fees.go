@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/monero-atm/atm-backend/money"
+)
+
+// Fee charged on inserted cash. Fields left out inherit from the rule it
+// overrides: a currency from its schedule or the defaults, a schedule from
+// the defaults.
+type feeRule struct {
+	// Fraction of the cash, e.g. 0.08 for 8%
+	Percent *float64 `yaml:"percent"`
+	// Smallest fee per currency in whole units
+	Minimum map[string]float64 `yaml:"minimum"`
+	// Percentages for larger amounts per currency
+	Tiers      map[string][]feeTier `yaml:"tiers"`
+	Currencies map[string]feeRule   `yaml:"currencies"`
+}
+
+type feeTier struct {
+	// Amount in whole units of the tier's currency from which it applies
+	From    float64 `yaml:"from"`
+	Percent float64 `yaml:"percent"`
+}
+
+// Fee rule in effect at certain times, e.g. a weekend promotion.
+type feeSchedule struct {
+	Name string `yaml:"name"`
+	// Weekdays, e.g. "sat", every day when empty
+	Days []string `yaml:"days"`
+	// Local time of day "15:04", wrapping past midnight when from is later
+	// than to. All day when empty.
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	// Dates "2006-01-02" the schedule is limited to, inclusive
+	Start string  `yaml:"start"`
+	End   string  `yaml:"end"`
+	Rule  feeRule `yaml:",inline"`
+}
+
+type feesConfig struct {
+	feeRule   `yaml:",inline"`
+	Schedules []feeSchedule `yaml:"schedules"`
+}
+
+// Fee rule resolved for one currency, in minor units. Quotes carry these so
+// the fee can't change during a transaction.
+type currencyFee struct {
+	Percent float64        `json:"percent"`
+	Minimum int64          `json:"minimum"`
+	Tiers   []resolvedTier `json:"tiers,omitempty"`
+}
+
+type resolvedTier struct {
+	From    int64   `json:"from"`
+	Percent float64 `json:"percent"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Fill in the defaults and check the config. The legacy fee option is the
+// default percentage.
+func (fc *feesConfig) prepare(legacyFee float64) error {
+	if fc.Percent == nil {
+		fc.Percent = &legacyFee
+	}
+	if err := fc.feeRule.validate(); err != nil {
+		return err
+	}
+	for i := range fc.Schedules {
+		sc := &fc.Schedules[i]
+		if err := sc.Rule.validate(); err != nil {
+			return fmt.Errorf("schedule %q: %w", sc.Name, err)
+		}
+		for _, d := range sc.Days {
+			if _, ok := weekdays[strings.ToLower(d)]; !ok {
+				return fmt.Errorf("schedule %q: unknown day %q", sc.Name, d)
+			}
+		}
+		for _, t := range []string{sc.From, sc.To} {
+			if _, err := time.Parse("15:04", t); t != "" && err != nil {
+				return fmt.Errorf("schedule %q: %w", sc.Name, err)
+			}
+		}
+		for _, d := range []string{sc.Start, sc.End} {
+			if _, err := time.Parse(time.DateOnly, d); d != "" && err != nil {
+				return fmt.Errorf("schedule %q: %w", sc.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Check the rule and uppercase its currencies like every other
+// currency-keyed option. Unset fields stay nil so they're inherited.
+func (r *feeRule) validate() error {
+	percents := []float64{}
+	if r.Percent != nil {
+		percents = append(percents, *r.Percent)
+	}
+	for _, tiers := range r.Tiers {
+		for _, t := range tiers {
+			percents = append(percents, t.Percent)
+		}
+	}
+	for _, p := range percents {
+		if p < 0 || p >= 1 {
+			return fmt.Errorf("fee percent %v out of range", p)
+		}
+	}
+	if r.Minimum != nil {
+		r.Minimum = upperKeys(r.Minimum)
+	}
+	for c := range r.Minimum {
+		if _, ok := currencyExponents[c]; !ok {
+			return fmt.Errorf("unknown currency %q in fee minimum", c)
+		}
+	}
+	if r.Tiers != nil {
+		tiers := make(map[string][]feeTier)
+		for c, ts := range r.Tiers {
+			c = strings.ToUpper(c)
+			if _, ok := currencyExponents[c]; !ok {
+				return fmt.Errorf("unknown currency %q in fee tiers", c)
+			}
+			sort.Slice(ts, func(i, j int) bool { return ts[i].From < ts[j].From })
+			tiers[c] = ts
+		}
+		r.Tiers = tiers
+	}
+	if r.Currencies != nil {
+		currencies := make(map[string]feeRule)
+		for c, cr := range r.Currencies {
+			c = strings.ToUpper(c)
+			if _, ok := currencyExponents[c]; !ok {
+				return fmt.Errorf("unknown currency %q in fees", c)
+			}
+			if err := cr.validate(); err != nil {
+				return err
+			}
+			currencies[c] = cr
+		}
+		r.Currencies = currencies
+	}
+	return nil
+}
+
+// Fields set in over take precedence, per currency for minimums and tiers.
+func (r feeRule) merge(over feeRule) feeRule {
+	if over.Percent != nil {
+		r.Percent = over.Percent
+	}
+	if over.Minimum != nil {
+		minimum := make(map[string]float64)
+		maps.Copy(minimum, r.Minimum)
+		maps.Copy(minimum, over.Minimum)
+		r.Minimum = minimum
+	}
+	if over.Tiers != nil {
+		tiers := make(map[string][]feeTier)
+		maps.Copy(tiers, r.Tiers)
+		maps.Copy(tiers, over.Tiers)
+		r.Tiers = tiers
+	}
+	if over.Currencies != nil {
+		r.Currencies = over.Currencies
+	}
+	return r
+}
+
+func (sc *feeSchedule) active(now time.Time) bool {
+	if len(sc.Days) > 0 {
+		found := false
+		for _, d := range sc.Days {
+			if weekdays[strings.ToLower(d)] == now.Weekday() {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	date := now.Format(time.DateOnly)
+	if (sc.Start != "" && date < sc.Start) || (sc.End != "" && date > sc.End) {
+		return false
+	}
+	if sc.From == "" || sc.To == "" {
+		return true
+	}
+	clock := now.Format("15:04")
+	if sc.From <= sc.To {
+		return clock >= sc.From && clock < sc.To
+	}
+	return clock >= sc.From || clock < sc.To
+}
+
+// Resolve the fee rules in effect now for every configured currency. The
+// first matching schedule wins.
+func (fc *feesConfig) resolve(now time.Time) (string, map[string]currencyFee) {
+	name := ""
+	rule := fc.feeRule
+	for _, sc := range fc.Schedules {
+		if sc.active(now) {
+			name = sc.Name
+			rule = rule.merge(sc.Rule)
+			break
+		}
+	}
+	fees := make(map[string]currencyFee)
+	for _, c := range cfg.Currencies {
+		r := rule
+		if cr, ok := rule.Currencies[c]; ok {
+			r = r.merge(cr)
+		}
+		cf := currencyFee{Percent: *r.Percent, Minimum: majorToMinor(c, r.Minimum[c])}
+		for _, t := range r.Tiers[c] {
+			cf.Tiers = append(cf.Tiers, resolvedTier{From: majorToMinor(c, t.From), Percent: t.Percent})
+		}
+		fees[c] = cf
+	}
+	return name, fees
+}
+
+// Percentage for an amount in minor units
+func (cf currencyFee) percent(amount int64) float64 {
+	p := cf.Percent
+	for _, t := range cf.Tiers {
+		if amount >= t.From {
+			p = t.Percent
+		}
+	}
+	return p
+}
+
+// Fee in minor units, rounded up and never more than the amount
+func (cf currencyFee) fee(amount int64) int64 {
+	// Parsed from its shortest decimal form, 0.08 is exactly 8/100.
+	p, _ := new(big.Rat).SetString(strconv.FormatFloat(cf.percent(amount), 'f', -1, 64))
+	fee, err := money.Minor(p.Mul(p, big.NewRat(amount, 1)), 0, money.RoundUp)
+	if err != nil {
+		fee = amount
+	}
+	if fee < cf.Minimum {
+		fee = cf.Minimum
+	}
+	if fee > amount {
+		fee = amount
+	}
+	return fee
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestFeeTiersPerCurrency(t *testing.T) {
+	cfg.Currencies = []string{"EUR", "CZK"}
+	var fc feesConfig
+	if err := yaml.Unmarshal([]byte(`
+percent: 0.1
+minimum:
+  eur: 1
+tiers:
+  eur:
+    - from: 1000
+      percent: 0.06
+    - from: 100
+      percent: 0.08
+currencies:
+  czk:
+    percent: 0.09
+schedules:
+  - name: "sunday"
+    days: ["sun"]
+    tiers:
+      czk:
+        - from: 2500
+          percent: 0.07
+`), &fc); err != nil {
+		t.Fatal(err)
+	}
+	if err := fc.prepare(0); err != nil {
+		t.Fatal(err)
+	}
+
+	monday := time.Date(2026, 10, 12, 12, 0, 0, 0, time.Local)
+	_, fees := fc.resolve(monday)
+	for _, tc := range []struct {
+		currency string
+		amount   int64
+		want     float64
+	}{
+		{"EUR", 9999, 0.1},
+		{"EUR", 10000, 0.08},
+		{"EUR", 100000, 0.06},
+		// 100 CZK is below the EUR tier's amount in EUR
+		{"CZK", 10000, 0.09},
+		{"CZK", 1000000, 0.09},
+	} {
+		if got := fees[tc.currency].percent(tc.amount); got != tc.want {
+			t.Errorf("%s %d: got %v, want %v", tc.currency, tc.amount, got, tc.want)
+		}
+	}
+	if fees["EUR"].Minimum != 100 {
+		t.Errorf("EUR minimum %d, want 100", fees["EUR"].Minimum)
+	}
+
+	_, fees = fc.resolve(monday.AddDate(0, 0, 6))
+	if got := fees["CZK"].percent(250000); got != 0.07 {
+		t.Errorf("scheduled CZK tier: got %v, want 0.07", got)
+	}
+	if got := fees["EUR"].percent(100000); got != 0.06 {
+		t.Errorf("EUR tiers inherited by the schedule: got %v, want 0.06", got)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EUR cross rates, units of a currency per EUR
+type fiatRateSet struct {
+	Source string `json:"source"`
+	// Publication date "2006-01-02", if the provider tells
+	Date      string             `json:"date,omitempty"`
+	FetchedAt time.Time          `json:"fetched_at"`
+	Rates     map[string]float64 `json:"rates"`
+}
+
+// Source of fiat cross rates for currencies without an XMR pair.
+type fiatRateProvider interface {
+	name() string
+	fetch() (*fiatRateSet, error)
+	// When to fetch again after a successful fetch
+	nextFetch(set *fiatRateSet, now time.Time) time.Time
+}
+
+// Fiat rate providers as configured, in order of priority
+type fiatRateProviderConfig struct {
+	// ecb, file, http or static
+	Type string `yaml:"type"`
+	// Defaults to the type
+	Name string `yaml:"name"`
+	// File of the file provider
+	Path string `yaml:"path"`
+	// Endpoint of the http provider, answering {"base": "EUR", "date":
+	// "2006-01-02", "rates": {"CZK": 25.1}}
+	Url string `yaml:"url"`
+	// Rates of the static provider, units per EUR
+	Rates map[string]float64 `yaml:"rates"`
+}
+
+func newFiatRateProvider(pc fiatRateProviderConfig) (fiatRateProvider, error) {
+	name := pc.Name
+	if name == "" {
+		name = pc.Type
+	}
+	switch pc.Type {
+	case "ecb":
+		return ecbProvider{n: name}, nil
+	case "file":
+		if pc.Path == "" {
+			return nil, fmt.Errorf("file fiat rate provider %q needs a path", name)
+		}
+		return fileProvider{n: name, path: pc.Path}, nil
+	case "http":
+		if pc.Url == "" {
+			return nil, fmt.Errorf("http fiat rate provider %q needs a url", name)
+		}
+		return httpProvider{n: name, url: pc.Url}, nil
+	case "static":
+		return staticProvider{n: name, rates: upperKeys(pc.Rates)}, nil
+	}
+	return nil, fmt.Errorf("unknown fiat rate provider type %q", pc.Type)
+}
+
+func upperKeys(m map[string]float64) map[string]float64 {
+	ret := make(map[string]float64)
+	for k, v := range m {
+		ret[strings.ToUpper(k)] = v
+	}
+	return ret
+}
+
+// Response of the file and http providers
+type fiatRateDocument struct {
+	Base  string             `json:"base"`
+	Date  string             `json:"date"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// Rebase the rates to EUR.
+func (d *fiatRateDocument) toSet(source string) (*fiatRateSet, error) {
+	rates := upperKeys(d.Rates)
+	base := strings.ToUpper(d.Base)
+	if base != "" && base != "EUR" {
+		eur, ok := rates["EUR"]
+		if !ok || eur <= 0 {
+			return nil, fmt.Errorf("no EUR rate to rebase %s rates", base)
+		}
+		for c, r := range rates {
+			rates[c] = r / eur
+		}
+		rates[base] = 1 / eur
+		delete(rates, "EUR")
+	}
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("no rates")
+	}
+	return &fiatRateSet{Source: source, Date: d.Date, FetchedAt: time.Now(), Rates: rates}, nil
+}
+
+type fileProvider struct {
+	n    string
+	path string
+}
+
+func (p fileProvider) name() string { return p.n }
+
+func (p fileProvider) fetch() (*fiatRateSet, error) {
+	b, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	var d fiatRateDocument
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return d.toSet(p.n)
+}
+
+func (p fileProvider) nextFetch(set *fiatRateSet, now time.Time) time.Time {
+	return now.Add(cfg.FiatRateRefresh)
+}
+
+type httpProvider struct {
+	n   string
+	url string
+}
+
+func (p httpProvider) name() string { return p.n }
+
+func (p httpProvider) fetch() (*fiatRateSet, error) {
+	cl := &http.Client{Timeout: 15 * time.Second}
+	resp, err := cl.Get(p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: %s", p.n, resp.Status)
+	}
+	var d fiatRateDocument
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, err
+	}
+	return d.toSet(p.n)
+}
+
+func (p httpProvider) nextFetch(set *fiatRateSet, now time.Time) time.Time {
+	return now.Add(cfg.FiatRateRefresh)
+}
+
+// Rates set by the operator in the config
+type staticProvider struct {
+	n     string
+	rates map[string]float64
+}
+
+func (p staticProvider) name() string { return p.n }
+
+func (p staticProvider) fetch() (*fiatRateSet, error) {
+	return &fiatRateSet{Source: p.n, FetchedAt: time.Now(), Rates: p.rates}, nil
+}
+
+func (p staticProvider) nextFetch(set *fiatRateSet, now time.Time) time.Time {
+	return now.Add(cfg.FiatRateRefresh)
+}
+
+// Freshness of one provider's rates
+type fiatRateInfo struct {
+	Source    string    `json:"source"`
+	Date      string    `json:"date,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// Older than fiat_rate_max_age
+	Stale bool `json:"stale"`
+}
+
+// Fiat rates behind a price update, shown in the price event
+type fiatRatesInfo struct {
+	Providers []fiatRateInfo `json:"providers"`
+	// Provider whose rate is used, per currency
+	Used map[string]string `json:"used"`
+	// Currencies whose providers disagree by more than
+	// fiat_rate_max_divergence
+	Divergent []string `json:"divergent,omitempty"`
+	// Divergent currencies without a rate most providers agree on. They
+	// aren't quoted.
+	Disputed []string `json:"disputed,omitempty"`
+	// A rate in use is stale
+	Stale bool `json:"stale"`
+}
+
+// Current rates of every provider, shared by the refreshers and the price
+// poller. They're cached on disk to survive a boot without network.
+type fiatRateStore struct {
+	mu        sync.Mutex
+	providers []fiatRateProvider
+	sets      map[string]*fiatRateSet
+}
+
+var fiatRates = &fiatRateStore{sets: make(map[string]*fiatRateSet)}
+
+// Load the rates cached by a previous run.
+func (st *fiatRateStore) load(path string) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var sets map[string]*fiatRateSet
+	if err == nil {
+		err = json.Unmarshal(b, &sets)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load cached fiat rates")
+		return
+	}
+	st.mu.Lock()
+	for name, set := range sets {
+		st.sets[name] = set
+	}
+	st.mu.Unlock()
+	log.Info().Int("providers", len(sets)).Msg("Loaded cached fiat rates")
+}
+
+func (st *fiatRateStore) set(set *fiatRateSet) {
+	st.mu.Lock()
+	st.sets[set.Source] = set
+	b, err := json.Marshal(st.sets)
+	st.mu.Unlock()
+	if err == nil {
+		// Written aside and renamed, so a crash can't leave half a file.
+		tmp := cfg.FiatRateCache + ".tmp"
+		if err = os.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, cfg.FiatRateCache)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to cache fiat rates")
+	}
+}
+
+func (set *fiatRateSet) stale() bool {
+	if published, err := time.ParseInLocation(time.DateOnly, set.Date, ecbZone); err == nil {
+		return time.Since(published) > cfg.FiatRateMaxAge
+	}
+	return time.Since(set.FetchedAt) > cfg.FiatRateMaxAge
+}
+
+// A provider's rate of a currency
+type providerRate struct {
+	source string
+	rate   float64
+	stale  bool
+}
+
+func ratesAgree(a, b float64) bool {
+	return cfg.FiatRateMaxDivergence <= 0 || math.Abs(a/b-1) <= cfg.FiatRateMaxDivergence
+}
+
+// Rate of a currency the providers agree on: the first provider's in
+// priority order when the others agree with it, otherwise the first one a
+// majority of the providers agrees with. False when there's none.
+func agreedRate(rates []providerRate) (providerRate, bool, bool) {
+	divergent := false
+	for _, r := range rates[1:] {
+		if !ratesAgree(r.rate, rates[0].rate) {
+			divergent = true
+		}
+	}
+	if !divergent {
+		return rates[0], false, true
+	}
+	for _, candidate := range rates {
+		agree := 0
+		for _, r := range rates {
+			if ratesAgree(r.rate, candidate.rate) {
+				agree++
+			}
+		}
+		if 2*agree > len(rates) {
+			return candidate, true, true
+		}
+	}
+	return providerRate{}, true, false
+}
+
+// Merge the providers' rates, the first provider in priority order that has
+// a currency wins when the others agree with it. Nil info when there are no
+// rates yet.
+func (st *fiatRateStore) get() (map[string]float64, *fiatRatesInfo) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.sets) == 0 {
+		return nil, nil
+	}
+	info := &fiatRatesInfo{Used: make(map[string]string)}
+	byCurrency := make(map[string][]providerRate)
+	for _, p := range st.providers {
+		set, ok := st.sets[p.name()]
+		if !ok {
+			continue
+		}
+		stale := set.stale()
+		info.Providers = append(info.Providers, fiatRateInfo{
+			Source:    set.Source,
+			Date:      set.Date,
+			FetchedAt: set.FetchedAt,
+			Stale:     stale,
+		})
+		for c, r := range set.Rates {
+			byCurrency[c] = append(byCurrency[c], providerRate{source: set.Source, rate: r, stale: stale})
+		}
+	}
+	rates := make(map[string]float64)
+	for c, prs := range byCurrency {
+		pr, divergent, ok := agreedRate(prs)
+		if divergent {
+			info.Divergent = append(info.Divergent, c)
+		}
+		if !ok {
+			info.Disputed = append(info.Disputed, c)
+			continue
+		}
+		rates[c] = pr.rate
+		info.Used[c] = pr.source
+		info.Stale = info.Stale || pr.stale
+	}
+	sort.Strings(info.Divergent)
+	sort.Strings(info.Disputed)
+	return rates, info
+}
+
+// Keep a provider's rates fresh. Failed fetches are retried until they
+// succeed, the cached rates are used meanwhile.
+func refreshFiatRates(p fiatRateProvider) {
+	for {
+		set, err := p.fetch()
+		if err != nil {
+			log.Error().Err(err).Str("provider", p.name()).Msg("Failed to get fiat rates")
+			<-time.After(cfg.FiatRateRetry)
+			continue
+		}
+		set.Source = p.name()
+		fiatRates.set(set)
+		_, info := fiatRates.get()
+		if len(info.Divergent) > 0 {
+			log.Warn().Strs("currencies", info.Divergent).Strs("disputed", info.Disputed).
+				Msg("Fiat rate providers disagree")
+		}
+		log.Info().Str("provider", p.name()).Str("date", set.Date).Msg("Got fiat rates")
+		<-time.After(time.Until(p.nextFetch(set, time.Now())))
+	}
+}
+
+// Start refreshing every configured provider.
+func startFiatRates() {
+	for _, p := range fiatRates.providers {
+		go refreshFiatRates(p)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFiatRateDivergence(t *testing.T) {
+	cfg.FiatRateMaxDivergence = 0.02
+	t.Cleanup(func() { cfg.FiatRateMaxDivergence = 0 })
+	st := &fiatRateStore{sets: make(map[string]*fiatRateSet)}
+	for _, p := range []struct {
+		name  string
+		rates map[string]float64
+	}{
+		{"primary", map[string]float64{"CZK": 25.0, "USD": 1.10, "GBP": 0.85}},
+		{"second", map[string]float64{"CZK": 24.3, "USD": 1.30, "GBP": 0.851}},
+		{"third", map[string]float64{"CZK": 24.4, "USD": 1.50}},
+	} {
+		st.providers = append(st.providers, staticProvider{n: p.name})
+		st.sets[p.name] = &fiatRateSet{Source: p.name, Rates: p.rates}
+	}
+
+	rates, info := st.get()
+	// GBP agrees, CZK falls back to the majority, USD has none.
+	want := map[string]float64{"GBP": 0.85, "CZK": 24.3}
+	for c, r := range want {
+		if rates[c] != r {
+			t.Errorf("%s: got %v, want %v", c, rates[c], r)
+		}
+	}
+	if _, ok := rates["USD"]; ok {
+		t.Error("disputed USD rate is used")
+	}
+	if info.Used["CZK"] != "second" || info.Used["GBP"] != "primary" {
+		t.Errorf("used %v", info.Used)
+	}
+	if !slices.Equal(info.Divergent, []string{"CZK", "USD"}) || !slices.Equal(info.Disputed, []string{"USD"}) {
+		t.Errorf("divergent %v, disputed %v", info.Divergent, info.Disputed)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How long handleIncoming waits for appLogic before telling the frontend
+// it's busy.
+const incomingTimeout = 2 * time.Second
+
+type ackData struct {
+	Event string `json:"event"`
+}
+
+type nackData struct {
+	Event  string `json:"event"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+func (s *sessionData) ack(front update) {
+	s.lastEvent = front.Event
+	s.lastEventAt = time.Now()
+	if err := s.sendToFrontend(update{Event: eventAck, Id: front.Id, Data: ackData{
+		Event: front.Event,
+	}}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+}
+
+func (s *sessionData) nack(front update, err error) {
+	log.Warn().Err(err).Str("kiosk", s.kiosk).Str("event", front.Event).
+		Str("id", front.Id).Msg("Refused frontend event")
+	if err := s.enqueue(update{Event: eventNack, Id: front.Id, Data: nackData{
+		Event:  front.Event,
+		Code:   errorCode(err),
+		Reason: err.Error(),
+	}}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+}
+
+// Report whether the message was already handled within the duplicate
+// window. A message without an ID is only a duplicate of the message
+// accepted last, so start, cancel, start goes through, and so does txinfo
+// repeated after a nack, e.g. to accept a new quote.
+func (s *sessionData) isDuplicate(front update) bool {
+	now := time.Now()
+	if front.Id == "" {
+		return front.Event == s.lastEvent && now.Sub(s.lastEventAt) <= cfg.DuplicateWindow
+	}
+	for k, t := range s.seen {
+		if now.Sub(t) > cfg.DuplicateWindow {
+			delete(s.seen, k)
+		}
+	}
+	if _, ok := s.seen[front.Id]; ok {
+		return true
+	}
+	s.seen[front.Id] = now
+	return false
+}
+
+// Tell the frontend it's busy when appLogic doesn't pick the message up in
+// time, e.g. during a payout. Runs outside appLogic.
+func (s *sessionData) deliverIncoming(c *frontendConn, message []byte) {
+	select {
+	case s.incoming <- message:
+	case <-time.After(incomingTimeout):
+		var front update
+		if err := json.Unmarshal(message, &front); err != nil {
+			return
+		}
+		s.nack(front, newProtocolError(codeBusy, "backend is busy, try again"))
+	case <-c.done:
+	}
+}
+
+func (s *sessionData) handleFrontend(front update) {
+	log.Info().Str("type", front.Event).Str("id", front.Id).Msg("Received frontend event")
+	if front.Event == evResume {
+		s.resume(front)
+		return
+	}
+	if !frontendEvents[front.Event] {
+		s.nack(front, newProtocolError(codeUnknownEvent, "unknown event %q", front.Event))
+		return
+	}
+	if s.isDuplicate(front) {
+		s.nack(front, newProtocolError(codeDuplicate, "duplicate %s", front.Event))
+		return
+	}
+	// Nothing is quoted or asked of the wallet for an event that would be
+	// refused anyway.
+	if _, err := s.allowed(front.Event); err != nil {
+		s.nack(front, err)
+		return
+	}
+	// Retries of a payout keep the quote of the first attempt.
+	if front.Event == evTxinfo && s.state == MoneyIn {
+		if err := s.ensureQuote(); err != nil {
+			s.nack(front, err)
+			return
+		}
+		s.estimateNetworkFee()
+		if err := s.checkMinimum(); err != nil {
+			s.nack(front, err)
+			return
+		}
+	}
+	if err := s.fire(front.Event); err != nil {
+		s.nack(front, err)
+		return
+	}
+	s.ack(front)
+
+	switch front.Event {
+	case evStart:
+		log.Info().Msg("Began new transaction")
+	case evTxinfo:
+		// Retries reuse the amount of the first attempt.
+		if s.payout == nil {
+			summary, err := s.summarize()
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to convert fiat")
+				s.sendError(err)
+				return
+			}
+			log.Info().Uint64("xmr", summary.Total).Str("quote", s.quote.Id).Msg("Converted fiat")
+			s.summary = summary
+			s.xmr = summary.Total
+			if err := s.sendToFrontend(update{Event: eventSummary, Data: summary}); err != nil {
+				log.Error().Err(err).Msg("Failed to send to frontend")
+			}
+			s.payout = &payout{Id: s.id, Address: s.address, Xmr: s.xmr}
+		}
+		s.executePayout()
+	case evCancel:
+		log.Info().Msg("Cancelled transaction")
+	case evFinal:
+		log.Info().Msg("Finalized transaction")
+	}
+}
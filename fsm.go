@@ -0,0 +1,217 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// Events driving the session state machine. The first six come from the
+// frontend, the rest from hardware or the backend itself.
+const (
+	evStart          = "start"
+	evMoneyin        = "moneyin"
+	evTxinfo         = "txinfo"
+	evCancel         = "cancel"
+	evFinal          = "final"
+	evConfirmAddress = "confirm_address"
+	evCodescan       = "codescan"
+	evNote           = "note"
+	evPaid           = "paid"
+	// Not a state transition, see resume.go
+	evResume = "resume"
+)
+
+// Events the frontend is allowed to send.
+var frontendEvents = map[string]bool{
+	evStart:          true,
+	evMoneyin:        true,
+	evTxinfo:         true,
+	evCancel:         true,
+	evFinal:          true,
+	evConfirmAddress: true,
+}
+
+type transition struct {
+	to State
+	// Refuses the transition when it returns an error.
+	guard func(s *sessionData) error
+	// Runs after leaving the old state and before entering the new one.
+	action func(s *sessionData)
+}
+
+type stateActions struct {
+	enter func(s *sessionData)
+	exit  func(s *sessionData)
+}
+
+// Every legal transition. Anything not listed here is rejected.
+var transitions = map[State]map[string]transition{
+	Idle: {
+		evStart:    {to: AddressIn, guard: priceAvailable, action: (*sessionData).begin},
+		evCodescan: {to: AddressIn, guard: priceAvailable, action: (*sessionData).begin},
+		// The note is in the cash box already, it's quoted later.
+		evNote:   {to: MoneyIn, action: (*sessionData).begin},
+		evCancel: {to: Idle},
+		evFinal:  {to: Idle},
+	},
+	AddressIn: {
+		evStart:          {to: AddressIn, action: (*sessionData).restart},
+		evCodescan:       {to: AddressIn},
+		evMoneyin:        {to: MoneyIn, guard: hasConfirmedAddress},
+		evConfirmAddress: {to: AddressIn, guard: hasAddress, action: (*sessionData).confirmAddress},
+		evNote:           {to: MoneyIn},
+		evCancel:         {to: Idle, action: (*sessionData).abandon},
+	},
+	MoneyIn: {
+		// Cash may arrive before the address was scanned.
+		evCodescan:       {to: MoneyIn, guard: lacksAddress},
+		evMoneyin:        {to: MoneyIn},
+		evNote:           {to: MoneyIn},
+		evConfirmAddress: {to: MoneyIn, guard: hasAddress, action: (*sessionData).confirmAddress},
+		evTxinfo:         {to: TxInfo, guard: canPayout},
+		evCancel:         {to: Idle, action: (*sessionData).abandon},
+	},
+	TxInfo: {
+		// Retry of a failed or unknown payout
+		evTxinfo: {to: TxInfo},
+		evPaid:   {to: Idle},
+		evCancel: {to: Idle, action: (*sessionData).abandon},
+	},
+}
+
+var states = map[State]stateActions{
+	Idle: {
+		enter: func(s *sessionData) {
+			s.reset()
+			// Stop bill acceptor, enable QR code scanning
+			s.cmd("moneyacceptord", "stop")
+			s.cmd("codescannerd", "start")
+		},
+	},
+	AddressIn: {
+		enter: func(s *sessionData) {
+			// Pause price updates and health checks
+			s.notifyPrice = false
+			s.cmd("codescannerd", "start")
+		},
+	},
+	MoneyIn: {
+		enter: func(s *sessionData) {
+			s.notifyPrice = false
+			s.cmd("moneyacceptord", "start")
+			s.restrictCurrencies()
+			if s.address != "" {
+				s.cmd("codescannerd", "stop")
+			}
+		},
+		exit: func(s *sessionData) {
+			s.cmd("moneyacceptord", "stop")
+		},
+	},
+	TxInfo: {},
+}
+
+var stateNames = map[State]string{
+	Idle:      "idle",
+	AddressIn: "addressin",
+	MoneyIn:   "moneyin",
+	TxInfo:    "txinfo",
+}
+
+func (st State) String() string {
+	return stateNames[st]
+}
+
+type rejectedData struct {
+	Event  string `json:"event"`
+	State  string `json:"state"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+func hasAddress(s *sessionData) error {
+	if s.address == "" {
+		return newProtocolError(codeNoAddress, "no address scanned")
+	}
+	return nil
+}
+
+func lacksAddress(s *sessionData) error {
+	if s.address != "" {
+		return newProtocolError(codeAddressAlreadyScanned, "address already scanned")
+	}
+	return nil
+}
+
+func priceAvailable(s *sessionData) error {
+	if s.priceUnavailable {
+		return newProtocolError(codePriceUnavailable, "no price available")
+	}
+	return nil
+}
+
+func canPayout(s *sessionData) error {
+	if err := hasConfirmedAddress(s); err != nil {
+		return err
+	}
+	if !hasBalance(s.fiatBalance) {
+		return newProtocolError(codeNoFunds, "no money inserted")
+	}
+	// Other kiosks may have paid the address in the meantime.
+	return s.checkBalanceLimits(limitCheckPayout, s.address)
+}
+
+// Whether an event would be accepted in the current state, checking its
+// guard without acting on it.
+func (s *sessionData) allowed(event string) (transition, error) {
+	t, ok := transitions[s.state][event]
+	if !ok {
+		return t, newProtocolError(codeIllegalTransition, "%s isn't allowed in state %s", event, s.state)
+	}
+	if t.guard != nil {
+		if err := t.guard(s); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// Attempt a transition. Exit and entry actions only run when the state
+// actually changes.
+func (s *sessionData) fire(event string) error {
+	t, err := s.allowed(event)
+	if err != nil {
+		return err
+	}
+	from := s.state
+	if t.to != from && states[from].exit != nil {
+		states[from].exit(s)
+	}
+	if t.action != nil {
+		t.action(s)
+	}
+	s.state = t.to
+	if t.to != from && states[t.to].enter != nil {
+		states[t.to].enter(s)
+	}
+	log.Debug().Str("kiosk", s.kiosk).Str("event", event).Stringer("from", from).
+		Stringer("to", t.to).Msg("State transition")
+	return nil
+}
+
+// Fire an event and tell the frontend if it was refused.
+func (s *sessionData) fireOrReject(event string) bool {
+	err := s.fire(event)
+	if err == nil {
+		return true
+	}
+	log.Warn().Err(err).Str("kiosk", s.kiosk).Str("event", event).Msg("Rejected event")
+	if err := s.sendToFrontend(update{Event: eventRejected, Data: rejectedData{
+		Event:  event,
+		State:  s.state.String(),
+		Code:   errorCode(err),
+		Reason: err.Error(),
+	}}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+	return false
+}
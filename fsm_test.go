@@ -0,0 +1,249 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var allStates = []State{Idle, AddressIn, MoneyIn, TxInfo}
+
+var allEvents = []string{
+	evStart, evMoneyin, evTxinfo, evCancel, evFinal, evConfirmAddress,
+	evCodescan, evNote, evPaid,
+}
+
+const testAddress = "44AFFq5kSiGBoZ4NMDwYtN18obc8AemS33DBLWs3H7otXft3XjrpDtQGv7SqSsaBYBb98uNbr2VBBEt7f2wfn3RVGQBEP3A"
+
+// Session in a state with the journal, ledger and audit log in a temporary
+// directory. Enter and exit actions are replaced by counters since they
+// talk to the broker.
+func testSession(t *testing.T, st State) (*sessionData, map[State]int, map[State]int) {
+	t.Helper()
+	dir := t.TempDir()
+	var err error
+	if journ, err = openJournal(filepath.Join(dir, "journal.log")); err != nil {
+		t.Fatal(err)
+	}
+	if auditLog, err = openJournal(filepath.Join(dir, "audit.log")); err != nil {
+		t.Fatal(err)
+	}
+	if ledg, err = openLedger(filepath.Join(dir, "ledger.log")); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Limits.minor = map[string]map[string]int64{}
+
+	entered, exited := make(map[State]int), make(map[State]int)
+	saved := states
+	states = make(map[State]stateActions)
+	for _, st := range allStates {
+		st := st
+		states[st] = stateActions{
+			enter: func(*sessionData) { entered[st]++ },
+			exit:  func(*sessionData) { exited[st]++ },
+		}
+	}
+	t.Cleanup(func() { states = saved })
+
+	s := newSession("test")
+	s.state = st
+	if st != Idle {
+		s.id = "session"
+	}
+	return s, entered, exited
+}
+
+func withAddress(s *sessionData) {
+	s.address = testAddress
+}
+
+func withUnconfirmedAddress(s *sessionData) {
+	s.address = testAddress
+	s.destination = &addressDetails{Address: testAddress, NeedsConfirmation: true}
+}
+
+func withConfirmedAddress(s *sessionData) {
+	withUnconfirmedAddress(s)
+	s.destination.Confirmed = true
+}
+
+func withBalance(s *sessionData) {
+	s.fiatBalance["EUR"] = 2000
+}
+
+func TestTransitions(t *testing.T) {
+	type testCase struct {
+		from  State
+		event string
+		setup []func(s *sessionData)
+		to    State
+		// Expected error code, empty when the transition is allowed
+		code string
+	}
+	// Every state × event pair without setup, then the guards.
+	cases := []testCase{
+		{from: Idle, event: evStart, to: AddressIn},
+		{from: Idle, event: evMoneyin, to: Idle, code: codeIllegalTransition},
+		{from: Idle, event: evTxinfo, to: Idle, code: codeIllegalTransition},
+		{from: Idle, event: evCancel, to: Idle},
+		{from: Idle, event: evFinal, to: Idle},
+		{from: Idle, event: evConfirmAddress, to: Idle, code: codeIllegalTransition},
+		{from: Idle, event: evCodescan, to: AddressIn},
+		{from: Idle, event: evNote, to: MoneyIn},
+		{from: Idle, event: evPaid, to: Idle, code: codeIllegalTransition},
+
+		{from: AddressIn, event: evStart, to: AddressIn},
+		{from: AddressIn, event: evMoneyin, to: AddressIn, code: codeNoAddress},
+		{from: AddressIn, event: evTxinfo, to: AddressIn, code: codeIllegalTransition},
+		{from: AddressIn, event: evCancel, to: Idle},
+		{from: AddressIn, event: evFinal, to: AddressIn, code: codeIllegalTransition},
+		{from: AddressIn, event: evConfirmAddress, to: AddressIn, code: codeNoAddress},
+		{from: AddressIn, event: evCodescan, to: AddressIn},
+		{from: AddressIn, event: evNote, to: MoneyIn},
+		{from: AddressIn, event: evPaid, to: AddressIn, code: codeIllegalTransition},
+
+		{from: MoneyIn, event: evStart, to: MoneyIn, code: codeIllegalTransition},
+		{from: MoneyIn, event: evMoneyin, to: MoneyIn},
+		{from: MoneyIn, event: evTxinfo, to: MoneyIn, code: codeNoAddress},
+		{from: MoneyIn, event: evCancel, to: Idle},
+		{from: MoneyIn, event: evFinal, to: MoneyIn, code: codeIllegalTransition},
+		{from: MoneyIn, event: evConfirmAddress, to: MoneyIn, code: codeNoAddress},
+		{from: MoneyIn, event: evCodescan, to: MoneyIn},
+		{from: MoneyIn, event: evNote, to: MoneyIn},
+		{from: MoneyIn, event: evPaid, to: MoneyIn, code: codeIllegalTransition},
+
+		{from: TxInfo, event: evStart, to: TxInfo, code: codeIllegalTransition},
+		{from: TxInfo, event: evMoneyin, to: TxInfo, code: codeIllegalTransition},
+		{from: TxInfo, event: evTxinfo, to: TxInfo},
+		{from: TxInfo, event: evCancel, to: Idle},
+		{from: TxInfo, event: evFinal, to: TxInfo, code: codeIllegalTransition},
+		{from: TxInfo, event: evConfirmAddress, to: TxInfo, code: codeIllegalTransition},
+		{from: TxInfo, event: evCodescan, to: TxInfo, code: codeIllegalTransition},
+		{from: TxInfo, event: evNote, to: TxInfo, code: codeIllegalTransition},
+		{from: TxInfo, event: evPaid, to: Idle},
+
+		{from: Idle, event: evStart, setup: []func(*sessionData){func(s *sessionData) { s.priceUnavailable = true }},
+			to: Idle, code: codePriceUnavailable},
+		{from: Idle, event: evCodescan, setup: []func(*sessionData){func(s *sessionData) { s.priceUnavailable = true }},
+			to: Idle, code: codePriceUnavailable},
+		{from: Idle, event: evNote, setup: []func(*sessionData){func(s *sessionData) { s.priceUnavailable = true }},
+			to: MoneyIn},
+		{from: AddressIn, event: evMoneyin, setup: []func(*sessionData){withAddress}, to: MoneyIn},
+		{from: AddressIn, event: evMoneyin, setup: []func(*sessionData){withUnconfirmedAddress},
+			to: AddressIn, code: codeAddressUnconfirmed},
+		{from: AddressIn, event: evMoneyin, setup: []func(*sessionData){withConfirmedAddress}, to: MoneyIn},
+		{from: AddressIn, event: evConfirmAddress, setup: []func(*sessionData){withUnconfirmedAddress}, to: AddressIn},
+		{from: MoneyIn, event: evConfirmAddress, setup: []func(*sessionData){withUnconfirmedAddress}, to: MoneyIn},
+		{from: MoneyIn, event: evCodescan, setup: []func(*sessionData){withAddress},
+			to: MoneyIn, code: codeAddressAlreadyScanned},
+		{from: MoneyIn, event: evTxinfo, setup: []func(*sessionData){withAddress},
+			to: MoneyIn, code: codeNoFunds},
+		{from: MoneyIn, event: evTxinfo, setup: []func(*sessionData){withUnconfirmedAddress, withBalance},
+			to: MoneyIn, code: codeAddressUnconfirmed},
+		{from: MoneyIn, event: evTxinfo, setup: []func(*sessionData){withConfirmedAddress, withBalance}, to: TxInfo},
+		{from: MoneyIn, event: evTxinfo, setup: []func(*sessionData){withAddress, withBalance, func(*sessionData) {
+			cfg.Limits.minor[limitSession] = map[string]int64{"EUR": 1000}
+		}}, to: MoneyIn, code: codeLimitExceeded},
+	}
+
+	covered := make(map[State]map[string]bool)
+	for _, tc := range cases {
+		if tc.setup != nil {
+			continue
+		}
+		if covered[tc.from] == nil {
+			covered[tc.from] = make(map[string]bool)
+		}
+		covered[tc.from][tc.event] = true
+	}
+	for _, st := range allStates {
+		for _, ev := range allEvents {
+			if !covered[st][ev] {
+				t.Errorf("no case for %s × %s", st, ev)
+			}
+		}
+		for ev := range transitions[st] {
+			if !covered[st][ev] {
+				t.Errorf("transition %s × %s isn't in the event list", st, ev)
+			}
+		}
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.from.String()+"/"+tc.event, func(t *testing.T) {
+			s, entered, exited := testSession(t, tc.from)
+			for _, setup := range tc.setup {
+				setup(s)
+			}
+			err := s.fire(tc.event)
+			if tc.code == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.code != "" {
+				if err == nil {
+					t.Fatalf("expected %s, got no error", tc.code)
+				}
+				if code := errorCode(err); code != tc.code {
+					t.Fatalf("expected %s, got %s: %v", tc.code, code, err)
+				}
+			}
+			if s.state != tc.to {
+				t.Fatalf("expected state %s, got %s", tc.to, s.state)
+			}
+
+			changed := err == nil && tc.to != tc.from
+			for _, st := range allStates {
+				wantEnter, wantExit := 0, 0
+				if changed && st == tc.to {
+					wantEnter = 1
+				}
+				if changed && st == tc.from {
+					wantExit = 1
+				}
+				if entered[st] != wantEnter {
+					t.Errorf("%s entered %d times, want %d", st, entered[st], wantEnter)
+				}
+				if exited[st] != wantExit {
+					t.Errorf("%s exited %d times, want %d", st, exited[st], wantExit)
+				}
+			}
+		})
+	}
+}
+
+func TestConfirmAddress(t *testing.T) {
+	s, _, _ := testSession(t, AddressIn)
+	withUnconfirmedAddress(s)
+	if err := s.fire(evConfirmAddress); err != nil {
+		t.Fatal(err)
+	}
+	if !s.destination.Confirmed {
+		t.Fatal("address isn't confirmed")
+	}
+	if err := hasConfirmedAddress(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxinfoRefusedBeforeQuote(t *testing.T) {
+	for _, tc := range []struct {
+		from  State
+		setup func(s *sessionData)
+	}{
+		{from: AddressIn, setup: withConfirmedAddress},
+		{from: MoneyIn, setup: withBalance},
+	} {
+		s, _, _ := testSession(t, tc.from)
+		tc.setup(s)
+		s.lastPrice = &priceUpdate{Status: priceLive, FetchedAt: time.Now(),
+			Currencies: []xmrPrice{{Short: "EUR", Market: 150, Amount: 150}}}
+		s.xmrPrices = map[string]float64{"EUR": 150}
+		s.handleFrontend(update{Event: evTxinfo, Id: "txinfo"})
+		if s.quote != nil {
+			t.Errorf("%s: refused txinfo was quoted", tc.from)
+		}
+		if s.state != tc.from {
+			t.Errorf("%s: state changed to %s", tc.from, s.state)
+		}
+	}
+}
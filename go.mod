@@ -9,6 +9,8 @@ require (
 	gitlab.com/moneropay/go-monero v1.1.1
 	gitlab.com/moneropay/moneropay/v2 v2.5.1
 	gitlab.com/openkiosk/proto v0.0.0-20230612142012-deb2b471c26e
+	golang.org/x/crypto v0.27.0
+	golang.org/x/net v0.29.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -16,6 +18,5 @@ require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/monero-atm/pricefetcher v0.3.0
-	golang.org/x/net v0.29.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
 )
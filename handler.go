@@ -2,15 +2,71 @@ package main
 
 import (
 	"encoding/json"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 	"gitlab.com/openkiosk/proto"
 )
 
-func handleEvents(payload []byte) {
+// Hardware events of a kiosk waiting for its appLogic. The MQTT callback is
+// shared by all kiosks, so it only queues and never waits on one. The queue
+// is unbounded since every moneyin event is cash in the box.
+type hardwareQueue struct {
+	mu    sync.Mutex
+	queue []proto.Event
+	// Signalled when the queue becomes non-empty
+	ready chan struct{}
+}
+
+func newHardwareQueue() *hardwareQueue {
+	return &hardwareQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *hardwareQueue) push(m proto.Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queue = append(q.queue, m)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *hardwareQueue) pop() (proto.Event, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queue) == 0 {
+		return proto.Event{}, false
+	}
+	m := q.queue[0]
+	q.queue = q.queue[1:]
+	return m, true
+}
+
+// Hand queued hardware events to appLogic in order, waiting as long as it's
+// busy, e.g. with a payout.
+func (s *sessionData) forwardHardware() {
+	for range s.hardware.ready {
+		for {
+			m, ok := s.hardware.pop()
+			if !ok {
+				break
+			}
+			s.okUpdate <- m
+		}
+	}
+}
+
+func handleEvents(topic string, payload []byte) {
 	var m proto.Event
 	if err := json.Unmarshal(payload, &m); err != nil {
 		log.Error().Err(err).Str("payload", string(payload)).Msg("Message could not be parsed")
+		return
+	}
+	s, ok := kiosks[kioskOfTopic(topic)]
+	if !ok {
+		log.Warn().Str("topic", topic).Msg("Message for unknown kiosk")
+		return
 	}
-	okUpdate <- m
+	s.hardware.push(m)
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Kinds of journal records. Every state transition of a session and every
+// inserted amount is appended to the journal before it's acted upon.
+const (
+	journalStart            = "start"
+	journalAddress          = "address"
+	journalAddressConfirmed = "address_confirmed"
+	journalMoneyin          = "moneyin"
+	journalQuote            = "quote"
+	journalPayoutPending    = "payout_pending"
+	journalPayoutFailed     = "payout_failed"
+	journalPayoutUnknown    = "payout_unknown"
+	journalPaid             = "paid"
+	journalCancel           = "cancel"
+	journalAbandoned        = "abandoned"
+	journalResumed          = "resumed"
+	journalRefundRequired   = "refund_required"
+	// Cash that arrived when the session couldn't take it
+	journalUnclaimed = "unclaimed_moneyin"
+)
+
+type journalRecord struct {
+	Session   string          `json:"session"`
+	Kind      string          `json:"kind"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+type journalStartData struct {
+	Kiosk string `json:"kiosk,omitempty"`
+}
+
+// Amount is in minor units of the currency.
+type journalMoneyinData struct {
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"`
+}
+
+// Recorded under a session of its own, which is then flagged for refund.
+// Amount is in minor units of the currency when it's known, otherwise as the
+// acceptor reported it.
+type journalUnclaimedData struct {
+	Kiosk string `json:"kiosk,omitempty"`
+	// Session the note arrived in, if any
+	Session  string `json:"session,omitempty"`
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"`
+}
+
+type journalPaidData struct {
+	Tx  string `json:"tx"`
+	Xmr uint64 `json:"xmr"`
+	// Realized network fee
+	Fee uint64 `json:"fee"`
+}
+
+type journalRefundData struct {
+	Kiosk       string           `json:"kiosk,omitempty"`
+	Address     string           `json:"address,omitempty"`
+	FiatBalance map[string]int64 `json:"fiat_balance"`
+	Reason      string           `json:"reason"`
+}
+
+// Append-only transaction journal. Each record is a JSON line that is
+// fsync'd before append returns.
+type journal struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Session reconstructed from the journal on startup.
+type journalSession struct {
+	id          string
+	kiosk       string
+	address     string
+	destination *addressDetails
+	fiatBalance map[string]int64
+	state       State
+	payout      *payout
+	finished    bool
+	// Cash the operator owes the customer
+	refund     *journalRefundData
+	lastUpdate time.Time
+}
+
+var journ *journal
+
+func newSessionId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal().Err(err).Msg("Failed to generate session ID")
+	}
+	return hex.EncodeToString(b)
+}
+
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{f: f}, nil
+}
+
+func (j *journal) append(session, kind string, data interface{}) error {
+	r := journalRecord{Session: session, Kind: kind, Timestamp: time.Now()}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		r.Data = b
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(line); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// Write a record and log if it failed. The session continues regardless,
+// since refusing service on a full disk helps no one.
+func (j *journal) record(session, kind string, data interface{}) {
+	if err := j.append(session, kind, data); err != nil {
+		log.Error().Err(err).Str("session", session).Str("kind", kind).
+			Msg("Failed to write journal record")
+	}
+}
+
+// Read the whole journal and return sessions that were never finished or
+// require an operator refund, ordered by the time they were last updated.
+func replayJournal(path string) ([]*journalSession, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sessions := make(map[string]*journalSession)
+	var order []string
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		var r journalRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			// A torn write at the tail is expected after a crash.
+			log.Warn().Err(err).Int("line", line).Msg("Skipping malformed journal record")
+			continue
+		}
+		js, ok := sessions[r.Session]
+		if !ok {
+			js = &journalSession{id: r.Session, fiatBalance: make(map[string]int64)}
+			sessions[r.Session] = js
+			order = append(order, r.Session)
+		}
+		js.lastUpdate = r.Timestamp
+		switch r.Kind {
+		case journalStart, journalResumed:
+			var d journalStartData
+			if err := json.Unmarshal(r.Data, &d); err == nil {
+				js.kiosk = d.Kiosk
+			}
+			js.finished = false
+			if js.state == Idle {
+				js.state = AddressIn
+			}
+		case journalAddress:
+			var d addressDetails
+			if err := json.Unmarshal(r.Data, &d); err == nil {
+				js.address = d.Address
+				js.destination = &d
+			}
+		case journalAddressConfirmed:
+			if js.destination != nil {
+				js.destination.Confirmed = true
+			}
+		case journalMoneyin:
+			var d journalMoneyinData
+			if err := json.Unmarshal(r.Data, &d); err == nil {
+				js.fiatBalance[d.Currency] += d.Amount
+				js.state = MoneyIn
+			}
+		case journalPayoutPending:
+			var p payout
+			if err := json.Unmarshal(r.Data, &p); err == nil {
+				p.status = payoutPending
+				js.payout = &p
+				js.state = TxInfo
+			}
+		case journalPayoutUnknown:
+			if js.payout != nil {
+				js.payout.status = payoutUnknown
+			}
+		case journalPayoutFailed:
+			js.payout = nil
+			js.state = MoneyIn
+		case journalPaid:
+			var d journalPaidData
+			if err := json.Unmarshal(r.Data, &d); err == nil {
+				paidTxs.add(d.Tx)
+			}
+			js.finished = true
+		case journalUnclaimed:
+			var d journalUnclaimedData
+			if err := json.Unmarshal(r.Data, &d); err == nil {
+				js.kiosk = d.Kiosk
+			}
+		case journalRefundRequired:
+			var d journalRefundData
+			if err := json.Unmarshal(r.Data, &d); err == nil {
+				if d.Kiosk != "" {
+					js.kiosk = d.Kiosk
+				}
+				js.refund = &d
+			}
+			js.finished = true
+		case journalCancel, journalAbandoned:
+			js.finished = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	var unfinished []*journalSession
+	for _, id := range order {
+		if js := sessions[id]; !js.finished || js.refund != nil {
+			unfinished = append(unfinished, js)
+		}
+	}
+	return unfinished, nil
+}
+
+func hasBalance(fiatBalance map[string]int64) bool {
+	for _, v := range fiatBalance {
+		if v != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Decide what to do with sessions the previous run left unfinished.
+// Interrupted payouts are reconciled first. The most recent session is
+// resumed if it's fresh enough, everything else holding cash is flagged for
+// operator refund. Refunds flagged earlier are reported again.
+func (s *sessionData) recover(sessions []*journalSession) {
+	var unfinished []*journalSession
+	for _, js := range sessions {
+		if js.refund == nil {
+			unfinished = append(unfinished, js)
+			continue
+		}
+		log.Warn().Str("session", js.id).Str("address", js.refund.Address).
+			Interface("fiat_balance", js.refund.FiatBalance).Str("reason", js.refund.Reason).
+			Time("since", js.lastUpdate).Msg("Transaction requires operator refund")
+	}
+	for i, js := range unfinished {
+		if p := js.payout; p != nil {
+			err := reconcilePayout(p)
+			switch p.status {
+			case payoutSent:
+				paidTxs.add(p.tx)
+				journ.record(js.id, journalPaid, journalPaidData{Tx: p.tx, Xmr: p.Xmr, Fee: p.fee})
+				creditLedger(js.id, p.Address, js.fiatBalance)
+				log.Info().Str("payout", p.Id).Str("tx", p.tx).Msg("Reconciled interrupted payout as sent")
+				continue
+			case payoutFailed:
+				journ.record(js.id, journalPayoutFailed, payoutFailedData{Id: p.Id, Reason: "not found in wallet"})
+				log.Info().Str("payout", p.Id).Msg("Reconciled interrupted payout as not sent")
+				js.payout = nil
+				js.state = MoneyIn
+			case payoutUnknown:
+				if cfg.WalletRpc != "" {
+					// Try again on the next start.
+					journ.record(js.id, journalPayoutUnknown, payoutFailedData{Id: p.Id, Reason: err.Error()})
+					log.Warn().Err(err).Str("payout", p.Id).Msg("Interrupted payout outcome is unknown")
+					continue
+				}
+			}
+		}
+		if !hasBalance(js.fiatBalance) {
+			journ.record(js.id, journalAbandoned, nil)
+			continue
+		}
+		last := i == len(unfinished)-1
+		if last && js.state != TxInfo && time.Since(js.lastUpdate) < cfg.JournalResumeMaxAge {
+			s.id = js.id
+			s.token = newSessionId()
+			s.address = js.address
+			s.destination = js.destination
+			s.fiatBalance = js.fiatBalance
+			s.state = MoneyIn
+			s.notifyPrice = false
+			journ.record(js.id, journalResumed, journalStartData{Kiosk: s.kiosk})
+			log.Warn().Str("session", js.id).Str("address", js.address).
+				Interface("fiat_balance", js.fiatBalance).Msg("Resumed unfinished transaction")
+			continue
+		}
+		reason := "stale session"
+		if js.payout != nil {
+			// We can't tell whether the payout went through.
+			reason = "unknown payout outcome"
+		}
+		journ.record(js.id, journalRefundRequired, journalRefundData{
+			Kiosk:       js.kiosk,
+			Address:     js.address,
+			FiatBalance: js.fiatBalance,
+			Reason:      reason,
+		})
+		log.Warn().Str("session", js.id).Str("address", js.address).
+			Interface("fiat_balance", js.fiatBalance).Str("reason", reason).
+			Msg("Unfinished transaction requires operator refund")
+	}
+}
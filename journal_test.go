@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestUnclaimedNoteRefund(t *testing.T) {
+	cfg.Currencies = []string{"EUR"}
+	cfg.MoneyinMinorUnits = false
+	s, _, _ := testSession(t, MoneyIn)
+	s.kiosk = "lobby"
+	s.unclaimedNote("USD", 20)
+
+	sessions, err := replayJournal(journ.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	js := sessions[0]
+	if js.id == s.id || js.id == "" {
+		t.Errorf("unclaimed note recorded under session %q", js.id)
+	}
+	if js.kiosk != "lobby" {
+		t.Errorf("kiosk %q, want lobby", js.kiosk)
+	}
+	if js.refund == nil || js.refund.FiatBalance["USD"] != 2000 {
+		t.Fatalf("refund %+v, want 2000 minor USD", js.refund)
+	}
+}
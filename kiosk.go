@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+	"gitlab.com/openkiosk/proto"
+)
+
+// Websocket connection of a kiosk's frontend. It's closed by whichever side
+// notices a failure first, or when another frontend replaces it.
+type frontendConn struct {
+	ws   *websocket.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newFrontendConn(ws *websocket.Conn) *frontendConn {
+	return &frontendConn{ws: ws, done: make(chan struct{})}
+}
+
+func (c *frontendConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.ws.Close()
+	})
+}
+
+func newSession(kiosk string) *sessionData {
+	return &sessionData{
+		kiosk:         kiosk,
+		xmrPrices:     make(map[string]float64),
+		fiatBalance:   make(map[string]int64),
+		limitsReached: make(map[string]bool),
+		notifyPrice:   true,
+		seen:          make(map[string]time.Time),
+		attach:        make(chan *frontendConn),
+		incoming:      make(chan []byte),
+		out:           newOutbox(),
+		okUpdate:      make(chan proto.Event),
+		hardware:      newHardwareQueue(),
+		priceEvent:    make(chan priceUpdate, 1),
+		healthEvent:   make(chan bool, 1),
+	}
+}
+
+// Identify the kiosk behind a websocket request. A verified client
+// certificate takes precedence over the header, which takes precedence over
+// the query parameter.
+func kioskId(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if id := r.Header.Get("X-Kiosk-Id"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("kiosk")
+}
+
+// MQTT topics of a kiosk are namespaced by its ID. The default kiosk with an
+// empty ID uses bare topics.
+func kioskTopic(kiosk, topic string) string {
+	if kiosk == "" {
+		return topic
+	}
+	return kiosk + "/" + topic
+}
+
+func kioskOfTopic(topic string) string {
+	kiosk, _, found := strings.Cut(topic, "/")
+	if !found {
+		return ""
+	}
+	return kiosk
+}
+
+func (s *sessionData) cmd(topic, c string) {
+	cmd(s.broker, kioskTopic(s.kiosk, topic), c)
+}
+
+func (s *sessionData) cmdData(topic, c string, data interface{}) {
+	cmdData(s.broker, kioskTopic(s.kiosk, topic), c, data)
+}
+
+func unfinishedOf(sessions []*journalSession, kiosk string) []*journalSession {
+	var ret []*journalSession
+	for _, js := range sessions {
+		if js.kiosk == kiosk {
+			ret = append(ret, js)
+		}
+	}
+	return ret
+}
+
+// Client certificates are optional, kiosks may still identify themselves
+// with the header or query parameter.
+func serverTlsConfig() *tls.Config {
+	tc := &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven}
+	if cfg.TlsClientCa == "" {
+		return tc
+	}
+	pem, err := os.ReadFile(cfg.TlsClientCa)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to read client CA")
+	}
+	tc.ClientCAs = x509.NewCertPool()
+	if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+		log.Fatal().Msg("No certificates found in client CA file")
+	}
+	return tc
+}
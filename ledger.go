@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Longest window any rolling limit looks back
+const ledgerRetention = 30 * 24 * time.Hour
+
+const ledgerPaid = "paid"
+
+// Cash paid out to an address, in minor units
+type ledgerEntry struct {
+	Address  string `json:"address"`
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"`
+	time     time.Time
+}
+
+// Rolling limits apply to the standard address, so fresh payment IDs of
+// integrated addresses don't get around them.
+func ledgerKey(address string) string {
+	a, err := decodeAddress(address)
+	if err != nil || a.Kind != addressIntegrated {
+		return address
+	}
+	return a.standard()
+}
+
+// Local store of what was paid to which address, backing the rolling
+// limits. It's shared by all kiosks.
+type ledger struct {
+	mu      sync.Mutex
+	entries []ledgerEntry
+	j       *journal
+}
+
+var ledg *ledger
+
+// Load the entries recent enough to matter and open the ledger for
+// appending.
+func openLedger(path string) (*ledger, error) {
+	l := &ledger{}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		since := time.Now().Add(-ledgerRetention)
+		sc := bufio.NewScanner(f)
+		for line := 1; sc.Scan(); line++ {
+			var r journalRecord
+			var e ledgerEntry
+			if err := json.Unmarshal(sc.Bytes(), &r); err != nil || r.Kind != ledgerPaid {
+				log.Warn().Err(err).Int("line", line).Msg("Skipping malformed ledger record")
+				continue
+			}
+			if err := json.Unmarshal(r.Data, &e); err != nil {
+				log.Warn().Err(err).Int("line", line).Msg("Skipping malformed ledger record")
+				continue
+			}
+			if r.Timestamp.Before(since) {
+				continue
+			}
+			e.time = r.Timestamp
+			// Entries written before integrated addresses were normalized
+			e.Address = ledgerKey(e.Address)
+			l.entries = append(l.entries, e)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if l.j, err = openJournal(path); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *ledger) add(session string, e ledgerEntry) {
+	e.time = time.Now()
+	l.j.record(session, ledgerPaid, e)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, e)
+}
+
+// Cash of a currency paid to an address within the window
+func (l *ledger) sum(address, currency string, window time.Duration) int64 {
+	since := time.Now().Add(-window)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var sum int64
+	for _, e := range l.entries {
+		if e.Address == address && e.Currency == currency && e.time.After(since) {
+			sum += e.Amount
+		}
+	}
+	return sum
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Scopes of limits on inserted cash
+const (
+	limitSession = "session"
+	limitDaily   = "daily"
+	limitMonthly = "monthly"
+)
+
+var limitWindows = map[string]time.Duration{
+	limitDaily:   24 * time.Hour,
+	limitMonthly: ledgerRetention,
+}
+
+// Maximum cash per currency in whole units, converted to minor units when
+// the config is loaded. Rolling limits apply per destination address.
+type limitsConfig struct {
+	Session map[string]float64 `yaml:"session"`
+	Daily   map[string]float64 `yaml:"daily"`
+	Monthly map[string]float64 `yaml:"monthly"`
+	// Largest note the acceptor takes per currency. A currency is stopped
+	// once such a note wouldn't fit anymore.
+	LargestNote map[string]float64 `yaml:"largest_note"`
+	minor       map[string]map[string]int64
+	largestNote map[string]int64
+}
+
+// How much of a limit is used, in minor units. Used includes the cash of the
+// transaction in progress.
+type limitState struct {
+	Scope     string `json:"scope"`
+	Currency  string `json:"currency"`
+	Limit     int64  `json:"limit"`
+	Used      int64  `json:"used"`
+	Remaining int64  `json:"remaining"`
+	// Limit for display
+	Display string `json:"display"`
+}
+
+// Tightest limit on cash of a currency for the given address, nil when
+// there's none.
+func (s *sessionData) tightestLimit(c, address string) *limitState {
+	var tightest *limitState
+	consider := func(scope string, used int64) {
+		limit, ok := cfg.Limits.minor[scope][c]
+		if !ok {
+			return
+		}
+		ls := &limitState{
+			Scope:     scope,
+			Currency:  c,
+			Limit:     limit,
+			Used:      used,
+			Remaining: limit - used,
+			Display:   formatFiat(c, limit),
+		}
+		if tightest == nil || ls.Remaining < tightest.Remaining {
+			tightest = ls
+		}
+	}
+	balance := s.fiatBalance[c]
+	consider(limitSession, balance)
+	if address != "" {
+		for _, scope := range []string{limitDaily, limitMonthly} {
+			consider(scope, balance+ledg.sum(ledgerKey(address), c, limitWindows[scope]))
+		}
+	}
+	return tightest
+}
+
+func (s *sessionData) auditLimit(check, address, c string, amount int64, ls *limitState, allowed bool) {
+	auditLog.record(s.id, auditLimit, auditLimitData{
+		Kiosk:    s.kiosk,
+		Check:    check,
+		Address:  address,
+		Currency: c,
+		Amount:   amount,
+		Allowed:  allowed,
+		Limit:    ls,
+	})
+}
+
+func limitExceeded(ls *limitState) error {
+	return newProtocolError(codeLimitExceeded, "%s limit of %s %s exceeded",
+		ls.Scope, ls.Display, ls.Currency)
+}
+
+// Check a note against the limits. The note is in the cash box already, so
+// one that doesn't fit is credited anyway and the payout is refused until the
+// transaction is cancelled and refunded.
+func (s *sessionData) admitNote(c string, amount int64) error {
+	ls := s.tightestLimit(c, s.address)
+	allowed := ls == nil || amount <= ls.Remaining
+	s.auditLimit(limitCheckNote, s.address, c, amount, ls, allowed)
+	if !allowed {
+		return limitExceeded(ls)
+	}
+	return nil
+}
+
+// Refuse an address scanned after cash that it can't receive anymore.
+func (s *sessionData) admitAddress(address string) error {
+	return s.checkBalanceLimits(limitCheckAddress, address)
+}
+
+func (s *sessionData) checkBalanceLimits(check, address string) error {
+	for c, balance := range s.fiatBalance {
+		ls := s.tightestLimit(c, address)
+		allowed := ls == nil || ls.Remaining >= 0
+		s.auditLimit(check, address, c, balance, ls, allowed)
+		if !allowed {
+			return limitExceeded(ls)
+		}
+	}
+	return nil
+}
+
+// Whether any more cash of a currency may be inserted, i.e. the largest
+// note still fits. Tells the frontend once when a limit is used up.
+func (s *sessionData) limitAllows(c string) bool {
+	ls := s.tightestLimit(c, s.address)
+	allows := ls == nil || ls.Remaining > 0 && ls.Remaining >= cfg.Limits.largestNote[c]
+	if allows || s.limitsReached[c] {
+		s.limitsReached[c] = !allows
+		return allows
+	}
+	s.limitsReached[c] = true
+	log.Info().Str("scope", ls.Scope).Str("currency", c).Msg("Limit reached")
+	if err := s.sendToFrontend(update{Event: eventLimitReached, Data: ls}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+	return false
+}
+
+// Credit a finished payout to the rolling limits of its address.
+func creditLedger(session, address string, fiatBalance map[string]int64) {
+	for c, balance := range fiatBalance {
+		if balance > 0 {
+			ledg.add(session, ledgerEntry{Address: ledgerKey(address), Currency: c, Amount: balance})
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimitsOfIntegratedAddresses(t *testing.T) {
+	cfg.Mode = networkMainnet
+	s, _, _ := testSession(t, MoneyIn)
+	cfg.Limits.minor[limitDaily] = map[string]int64{"EUR": 100000}
+
+	a, err := decodeAddress(testAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := a.integrate([]byte{1, 2, 3, 4, 5, 6, 7, 8}).Address
+	second := a.integrate([]byte{8, 7, 6, 5, 4, 3, 2, 1}).Address
+	creditLedger("paid", first, map[string]int64{"EUR": 60000})
+
+	for _, address := range []string{testAddress, first, second} {
+		ls := s.tightestLimit("EUR", address)
+		if ls == nil || ls.Remaining != 40000 {
+			t.Errorf("%s: got %+v, want 40000 remaining", address, ls)
+		}
+	}
+}
+
+func TestLimitReachedOnce(t *testing.T) {
+	s, _, _ := testSession(t, MoneyIn)
+	s.out.attach(&frontendConn{done: make(chan struct{})})
+	cfg.Limits.minor[limitSession] = map[string]int64{"EUR": 100000}
+	cfg.Limits.largestNote = map[string]int64{"EUR": 50000}
+	t.Cleanup(func() { cfg.Limits.largestNote = nil })
+
+	reached := func() int {
+		n := 0
+		for _, m := range s.out.queue {
+			if strings.Contains(string(m), eventLimitReached) {
+				n++
+			}
+		}
+		return n
+	}
+	s.fiatBalance["EUR"] = 50000
+	if !s.limitAllows("EUR") {
+		t.Fatal("a largest note still fits")
+	}
+	s.fiatBalance["EUR"] = 60000
+	for i := 0; i < 3; i++ {
+		if s.limitAllows("EUR") {
+			t.Fatal("a largest note doesn't fit anymore")
+		}
+	}
+	if n := reached(); n != 1 {
+		t.Fatalf("limit reached sent %d times, want 1", n)
+	}
+
+	// Told again after the limit was lifted in between.
+	s.fiatBalance["EUR"] = 0
+	s.limitAllows("EUR")
+	s.fiatBalance["EUR"] = 60000
+	s.limitAllows("EUR")
+	if n := reached(); n != 2 {
+		t.Fatalf("limit reached sent %d times, want 2", n)
+	}
+}
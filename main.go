@@ -5,12 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
-	"gitlab.com/moneropay/go-monero/walletrpc"
 	mpay "gitlab.com/moneropay/moneropay/v2/pkg/model"
 	"gitlab.com/openkiosk/proto"
 )
@@ -26,44 +26,71 @@ const (
 
 type update struct {
 	// keyword description of what happened
-	Event     string      `json:"event"`
+	Event string `json:"event"`
+	// Optional correlation ID set by the frontend and echoed in replies
+	Id        string      `json:"id,omitempty"`
 	Data      interface{} `json:"value"`
 	Timestamp time.Time   `json:"timestamp"`
 }
 
 type sessionData struct {
-	conn        *websocket.Conn
-	broker      *autopaho.ConnectionManager
-	state       State
-	address     string
+	id      string
+	kiosk   string
+	conn    *frontendConn
+	broker  *autopaho.ConnectionManager
+	state   State
+	address string
+	// Decoded address and whether the customer confirmed it
+	destination *addressDetails
 	fiatBalance map[string]int64
 	xmr         uint64
 	xmrPrices   map[string]float64
 	err         error
 	tx          *mpay.TransferPostResponse
+	payout      *payout
+	quote       *quote
+	summary     *payoutSummary
+	networkFee  *uint64
 	lastPrice   *priceUpdate
+	lastHealth  *bool
+	// No usable price, new transactions are refused
+	priceUnavailable bool
+	// Lets a reloaded frontend resume the transaction
+	token string
+	// ID of the frontend message being handled
+	replyTo string
+	// Recently handled frontend messages, for duplicate suppression
+	seen map[string]time.Time
+	// Currencies whose limit the frontend was told is reached
+	limitsReached map[string]bool
+	// Event of the last accepted frontend message, for messages without an ID
+	lastEvent   string
+	lastEventAt time.Time
+	// Price and health updates are shown and prices may change only while
+	// there's no transaction in progress.
 	notifyPrice bool
-}
-
-var (
-	session *sessionData
 
-	// to signal end of websocket session on errors
-	endSession chan struct{}
+	// Frontend connections attaching to this kiosk
+	attach chan *frontendConn
 
 	// Updates from frontend
 	incoming chan []byte
 
 	// Updates to frontend
-	outgoing chan []byte
+	out *outbox
 
 	// OpenKiosk events
 	okUpdate chan proto.Event
+	hardware *hardwareQueue
 
-	priceEvent chan priceUpdate
-	pricePause chan bool
+	priceEvent  chan priceUpdate
+	healthEvent chan bool
+}
 
-	mpayHealthPause chan bool
+var (
+	// Kiosks driven by this backend, keyed by kiosk ID. Populated on startup
+	// and only read afterwards.
+	kiosks map[string]*sessionData
 
 	cfg backendConfig
 )
@@ -71,85 +98,141 @@ var (
 var upgrader = websocket.Upgrader{} // use default options
 
 type txinfoData struct {
-	Tx     string `json:"tx"`
-	Amount string `json:"amount"`
+	Tx      string         `json:"tx"`
+	Amount  string         `json:"amount"`
+	Summary *payoutSummary `json:"summary,omitempty"`
+	// Network fee actually paid
+	NetworkFee string `json:"network_fee"`
+}
+
+type resumedData struct {
+	Token       string           `json:"token"`
+	Address     string           `json:"address"`
+	Destination *addressDetails  `json:"destination,omitempty"`
+	FiatBalance map[string]int64 `json:"fiat_balance"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "protocol" {
+		protocolCommand(os.Args[2:])
+		return
+	}
 	cfg = loadConfig()
-	endSession = make(chan struct{})
-	incoming = make(chan []byte)
-	outgoing = make(chan []byte)
-	priceEvent = make(chan priceUpdate)
-	pricePause = make(chan bool)
-	mpayHealthPause = make(chan bool)
-	okUpdate = make(chan proto.Event)
-
-	session = &sessionData{
-		broker:      connectToBroker(),
-		xmrPrices:   make(map[string]float64),
-		fiatBalance: make(map[string]int64),
-		notifyPrice: true,
+
+	unfinished, err := replayJournal(cfg.Journal)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to replay journal")
+	}
+	if journ, err = openJournal(cfg.Journal); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open journal")
+	}
+	if ledg, err = openLedger(cfg.Ledger); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open ledger")
+	}
+	if auditLog, err = openJournal(cfg.AuditLog); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open audit log")
+	}
+	if cfg.AddressList != "" {
+		if err := screening.load(cfg.AddressList); err != nil {
+			log.Fatal().Err(err).Msg("Failed to load address list")
+		}
+		go watchAddressList(cfg.AddressList)
 	}
 
-	go session.appLogic()
-	go pricePoll(cfg.Currencies, cfg.FiatRates, cfg.Fee)
+	// Kiosks must exist before MQTT messages start arriving.
+	kiosks = make(map[string]*sessionData)
+	for _, id := range cfg.Kiosks {
+		kiosks[id] = newSession(id)
+	}
+	broker := connectToBroker()
+	for _, id := range cfg.Kiosks {
+		s := kiosks[id]
+		s.broker = broker
+		s.recover(unfinishedOf(unfinished, id))
+		if s.state == MoneyIn {
+			states[MoneyIn].enter(s)
+			// Delivered once the frontend connects.
+			if err := s.sendToFrontend(update{Event: eventResumed, Data: resumedData{
+				Token:       s.token,
+				Address:     s.address,
+				Destination: s.destination,
+				FiatBalance: s.fiatBalance,
+			}}); err != nil {
+				log.Error().Err(err).Msg("Failed to send to frontend")
+			}
+		}
+		go s.forwardHardware()
+		go s.appLogic()
+	}
+
+	fiatRates.load(cfg.FiatRateCache)
+	startFiatRates()
+	go pricePoll(cfg.Currencies, *cfg.Fees.Percent)
 	go mpayHealthPoll()
 
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	upgrader.Subprotocols = supportedSubprotocols
 	http.HandleFunc("/ws", atmSessionHandler)
+	if cfg.TlsCert != "" {
+		srv := &http.Server{Addr: cfg.Bind, TLSConfig: serverTlsConfig()}
+		log.Fatal().Err(srv.ListenAndServeTLS(cfg.TlsCert, cfg.TlsKey)).Msg("Failed to bind")
+	}
 	log.Fatal().Err(http.ListenAndServe(cfg.Bind, nil)).Msg("Failed to bind")
 }
 
 func atmSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := kioskId(r)
+	s, ok := kiosks[id]
+	if !ok {
+		log.Warn().Str("kiosk", id).Msg("Rejected connection from unknown kiosk")
+		http.Error(w, "unknown kiosk", http.StatusNotFound)
+		return
+	}
+	if !checkSubprotocol(w, r) {
+		return
+	}
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Error().Err(err).Msg("Websocket update")
 		return
 	}
-	session.conn = c
-	cmd(session.broker, "codescannerd", "start")
-
-	go session.handleIncoming()
-	go session.handleOutgoing()
+	s.attach <- newFrontendConn(c)
 }
 
 // Updates arriving from the frontend: cancel transaction, stop price update
-func (s *sessionData) handleIncoming() {
+func (s *sessionData) handleIncoming(c *frontendConn) {
 	for {
-		select {
-		case <-endSession:
-			log.Debug().Msg("Exited handleIncoming")
+		mt, message, err := c.ws.ReadMessage()
+		if err != nil {
+			log.Error().Err(err).Str("kiosk", s.kiosk).Msg("Websocket read")
+			c.close()
 			return
-		default:
-			mt, message, err := s.conn.ReadMessage()
-			if err != nil {
-				log.Error().Err(err).Msg("Websocket read")
-				endSession <- struct{}{}
-				return
-			}
+		}
 
-			// Skip non-text messages
-			if mt != 1 {
-				continue
-			}
-			incoming <- message
+		// Skip non-text messages
+		if mt != 1 {
+			continue
 		}
+		s.deliverIncoming(c, message)
 	}
 }
 
 // Updates to the frontend: money inserted, sent, backend error
-func (s *sessionData) handleOutgoing() {
+func (s *sessionData) handleOutgoing(c *frontendConn) {
+	defer s.out.detach(c)
 	for {
-		select {
-		case m := <-outgoing:
-			err := s.conn.WriteMessage(1, m)
-			if err != nil {
-				log.Error().Err(err).Msg("Websocket write")
-				endSession <- struct{}{}
+		for m, ok := s.out.pop(c); ok; m, ok = s.out.pop(c) {
+			if err := c.ws.WriteMessage(1, m); err != nil {
+				log.Error().Err(err).Str("kiosk", s.kiosk).Msg("Websocket write")
+				// Keep it for the next connection.
+				s.out.unpop(m)
+				c.close()
 				return
 			}
-		case <-endSession:
+		}
+		select {
+		case <-s.out.ready:
+		case <-c.done:
 			log.Debug().Msg("Exited handleOutgoing")
 			return
 		}
@@ -161,68 +244,31 @@ func (s *sessionData) handleOutgoing() {
 func (s *sessionData) appLogic() {
 	for {
 		select {
-		case frontendUpdate := <-incoming:
+		case c := <-s.attach:
+			if s.conn != nil {
+				// Only one frontend per kiosk, the newest one wins.
+				log.Warn().Str("kiosk", s.kiosk).Msg("Replacing frontend connection")
+				s.conn.close()
+			}
+			s.conn = c
+			s.out.attach(c)
+			s.greet()
+			if s.state == Idle {
+				s.cmd("codescannerd", "start")
+			}
+			go s.handleIncoming(c)
+			go s.handleOutgoing(c)
+		case frontendUpdate := <-s.incoming:
 			var front update
 			if err := json.Unmarshal(frontendUpdate, &front); err != nil {
 				log.Error().Err(err).Msg("Malformed frontend update")
+				s.nack(front, newProtocolError(codeMalformedMessage, "malformed message: %s", err))
 				continue
 			}
-			log.Info().Str("type", front.Event).Msg("Received frontend event")
-			switch front.Event {
-			case "start":
-				s.reset()
-				s.state = AddressIn
-				// Pause price updates and health checks
-				pricePause <- true
-				mpayHealthPause <- true
-				s.notifyPrice = false
-				log.Info().Msg("Began new transaction")
-			case "moneyin":
-				s.state = MoneyIn
-				cmd(s.broker, "moneyacceptord", "start")
-				cmd(s.broker, "codescannerd", "stop")
-			case "txinfo":
-				s.state = TxInfo
-				cmd(s.broker, "moneyacceptord", "stop")
-
-				fmt.Printf("%v\n", s.fiatBalance)
-				// Calculate xmr given the rate and fiat
-				var xmrFloat float64 = 0
-				for currShort, balance := range s.fiatBalance {
-					xf := float64(balance) / s.xmrPrices[currShort]
-					log.Info().Float64("summing up", xf).Msg("")
-					xmrFloat += xf
-				}
-				s.xmr = uint64(xmrFloat * 1000000000000)
-				log.Info().Uint64("xmr", s.xmr).Float64("xmrFloat", xmrFloat).Msg("calc")
-				s.tx, s.err = mpayTransfer(s.xmr, s.address)
-				if s.err != nil {
-					log.Error().Err(s.err).Msg("Failed to transfer")
-					if err := sendToFrontend(update{Event: "error", Data: s.err.Error()}); err != nil {
-						log.Error().Err(s.err).Msg("Failed to send to frontend")
-					}
-					continue
-				}
-				xmrString := walletrpc.XMRToDecimal(s.xmr)
-				log.Info().Str("amount", xmrString).Str("address", s.address).Msg("Sent XMR")
-				if err := sendToFrontend(update{
-					Event: "txinfo", Data: txinfoData{
-						Tx:     s.tx.TxHashList[0],
-						Amount: xmrString,
-					},
-				}); err != nil {
-					log.Error().Err(s.err).Msg("Failed to send to frontend")
-				}
-				s.reset()
-				log.Info().Msg("Finalized transaction")
-			case "cancel":
-				s.reset()
-				log.Info().Msg("Cancelled transaction")
-			case "final":
-				s.reset()
-				log.Info().Msg("Finalized transaction")
-			}
-		case hardwareUpdate := <-okUpdate:
+			s.replyTo = front.Id
+			s.handleFrontend(front)
+			s.replyTo = ""
+		case hardwareUpdate := <-s.okUpdate:
 			log.Info().Str("type", hardwareUpdate.Event).Msg("")
 			if hardwareUpdate.Event == "codescan" {
 				log.Info().Str("data", fmt.Sprintf("%v", hardwareUpdate)).Msg("")
@@ -236,23 +282,51 @@ func (s *sessionData) appLogic() {
 					log.Error().Err(err).Msg("Failed to base64 decode scan data")
 					continue
 				}
-				addr := parseAddress(string(decoded))
-				if err := addressValidator(addr); err != nil {
+				uri, err := parseMoneroUri(string(decoded))
+				if err != nil {
+					log.Error().Err(err).Msg("Invalid URI received")
+					s.sendError(err)
+					continue
+				}
+				decodedAddr, err := uri.destination()
+				if err != nil {
 					log.Error().Err(err).Msg("Invalid address received")
-					if err := sendToFrontend(update{Event: "error", Data: err.Error()}); err != nil {
-						log.Error().Err(err).Msg("Failed to send to frontend")
-					}
+					s.sendError(err)
+					continue
 				}
-				s.address = addr
-				if err := sendToFrontend(update{Event: "addressin", Data: addr}); err != nil {
-					log.Error().Err(err).Msg("Failed to send to frontend")
+				addr := decodedAddr.Address
+				flag, err := s.screenAddress(decodedAddr)
+				if err != nil {
+					s.sendError(err)
+					continue
+				}
+				if err := s.admitAddress(addr); err != nil {
+					log.Warn().Err(err).Msg("Address refused by limits")
+					s.sendError(err)
+					continue
 				}
-
 				// If this transaction began not by tapping the screen but by scanning QR
-				if s.state == Idle {
-					pricePause <- true
-					mpayHealthPause <- true
-					s.notifyPrice = false
+				beganByScan := s.state == Idle
+				if !s.fireOrReject(evCodescan) {
+					continue
+				}
+				s.setDestination(decodedAddr, uri, flag)
+				if s.state == MoneyIn {
+					s.cmd("codescannerd", "stop")
+					// Rolling limits of the address apply from now on.
+					s.restrictCurrencies()
+				}
+				if err := s.sendToFrontend(update{Event: eventAddressin, Data: addr}); err != nil {
+					log.Error().Err(err).Msg("Failed to send to frontend")
+				}
+				if err := s.sendToFrontend(update{Event: eventAddressDetails, Data: s.destination}); err != nil {
+					log.Error().Err(err).Msg("Failed to send to frontend")
+				}
+				if s.target() > 0 {
+					s.sendSummary()
+				}
+				log.Info().Str("network", decodedAddr.Network).Str("kind", decodedAddr.Kind).Msg("Accepted address")
+				if beganByScan {
 					log.Info().Msg("Began new transaction")
 				}
 			}
@@ -261,46 +335,161 @@ func (s *sessionData) appLogic() {
 				data, err := proto.GetMoneyinData(hardwareUpdate.Data)
 				if err != nil {
 					log.Error().Err(err).Msg("Failed to unmarshall scan data")
+					continue
 				}
-				s.fiatBalance[data.Currency] += data.Amount
-				if err := sendToFrontend(update{Event: "moneyin", Data: data}); err != nil {
+				currency := normalizeCurrency(data.Currency)
+				amount, err := toMinorUnits(currency, data.Amount)
+				if err == nil {
+					err = s.allowCurrency(currency)
+				}
+				if err != nil {
+					log.Warn().Err(err).Msg("Rejected note")
+					s.sendError(err)
+				}
+				if err != nil || !s.fireOrReject(evNote) {
+					s.unclaimedNote(currency, data.Amount)
+					continue
+				}
+				if err := s.admitNote(currency, amount); err != nil {
+					log.Warn().Err(err).Msg("Credited note over the limit")
+					s.sendError(err)
+				}
+				journ.record(s.id, journalMoneyin, journalMoneyinData{Currency: currency, Amount: amount})
+				s.fiatBalance[currency] += amount
+				s.restrictCurrencies()
+				if err := s.sendToFrontend(update{Event: eventMoneyin, Data: newMoneyinData(currency, amount)}); err != nil {
 					log.Error().Err(err).Msg("Failed to send to frontend")
 				}
-				fmt.Printf("fiat balance: %v\n", s.fiatBalance)
+				s.sendSummary()
+				log.Info().Interface("fiat_balance", s.fiatBalance).Msg("Cash inserted")
 			}
 
-		case price := <-priceEvent:
+		case price := <-s.priceEvent:
 			s.lastPrice = &price
+			if price.Status == priceUnavailable {
+				if !s.priceUnavailable {
+					s.priceUnavailable = true
+					if err := s.sendToFrontend(update{Event: eventPriceUnavailable}); err != nil {
+						log.Error().Err(err).Msg("Failed to send to frontend")
+					}
+				}
+				continue
+			}
+			if s.priceUnavailable {
+				s.priceUnavailable = false
+				if err := s.sendToFrontend(update{Event: eventPriceAvailable}); err != nil {
+					log.Error().Err(err).Msg("Failed to send to frontend")
+				}
+			}
+			// Fallback prices may not cover every currency.
+			s.xmrPrices = make(map[string]float64)
 			for _, pc := range price.Currencies {
-				s.xmrPrices[pc.Short] = pc.Amount
+				s.xmrPrices[pc.Short] = pc.Market
+			}
+			if s.state == MoneyIn {
+				s.restrictCurrencies()
+			}
+
+		case isHealthy := <-s.healthEvent:
+			s.lastHealth = &isHealthy
+			if !s.notifyPrice {
+				continue
+			}
+			if err := s.sendToFrontend(update{Event: eventMpayHealth, Data: isHealthy}); err != nil {
+				log.Error().Err(err).Msg("Failed to send MoneroPay health status update")
 			}
 
 		case <-time.After(cfg.PriceNotifyFreq):
 			if !s.notifyPrice || s.lastPrice == nil {
 				continue
 			}
-			if err := sendToFrontend(update{Event: "price", Data: s.lastPrice}); err != nil {
+			if err := s.sendToFrontend(update{Event: eventPrice, Data: s.lastPrice}); err != nil {
 				log.Error().Err(err).Msg("Failed to send to frontend")
 			}
 		}
 	}
 }
 
+// Start journaling a new transaction.
+func (s *sessionData) begin() {
+	s.id = newSessionId()
+	s.token = newSessionId()
+	journ.record(s.id, journalStart, journalStartData{Kiosk: s.kiosk})
+	s.sendSessionToken()
+	if err := s.requote(); err != nil {
+		// Quoted later, when the customer wants to be paid.
+		log.Warn().Err(err).Msg("Failed to quote")
+	}
+}
+
+// Close the current transaction in the journal without a payout. Inserted
+// cash is flagged so the operator can refund it.
+func (s *sessionData) abandon() {
+	if s.id == "" {
+		return
+	}
+	if !hasBalance(s.fiatBalance) {
+		journ.record(s.id, journalCancel, nil)
+		return
+	}
+	reason := "cancelled"
+	if s.payout != nil && s.payout.status != payoutFailed {
+		reason = "unknown payout outcome"
+	}
+	journ.record(s.id, journalRefundRequired, journalRefundData{
+		Kiosk:       s.kiosk,
+		Address:     s.address,
+		FiatBalance: s.fiatBalance,
+		Reason:      reason,
+	})
+	log.Warn().Str("session", s.id).Interface("fiat_balance", s.fiatBalance).
+		Str("reason", reason).Msg("Cancelled transaction requires operator refund")
+}
+
+// The note is in the cash box already but the session can't take it. It's
+// flagged for refund so the operator doesn't lose track of it.
+func (s *sessionData) unclaimedNote(currency string, amount int64) {
+	minor, err := acceptorMinorUnits(currency, amount)
+	if err != nil {
+		minor = amount
+	}
+	id := newSessionId()
+	journ.record(id, journalUnclaimed, journalUnclaimedData{
+		Kiosk: s.kiosk, Session: s.id, Currency: currency, Amount: minor,
+	})
+	journ.record(id, journalRefundRequired, journalRefundData{
+		Kiosk:       s.kiosk,
+		Address:     s.address,
+		FiatBalance: map[string]int64{currency: minor},
+		Reason:      "unclaimed note",
+	})
+	log.Warn().Str("session", id).Str("currency", currency).Int64("amount", minor).
+		Msg("Unclaimed note requires operator refund")
+}
+
+// Drop the current transaction and begin a new one.
+func (s *sessionData) restart() {
+	s.abandon()
+	s.reset()
+	s.begin()
+	s.notifyPrice = false
+}
+
 func (s *sessionData) reset() {
 	// Reset all data from previous transaction
-	s.state = Idle
+	s.id = ""
+	s.token = ""
 	s.address = ""
+	s.destination = nil
 	s.fiatBalance = make(map[string]int64)
+	s.limitsReached = make(map[string]bool)
 	s.xmr = 0
 	s.err = nil
 	s.tx = nil
-	s.notifyPrice = true
-
+	s.payout = nil
+	s.quote = nil
+	s.summary = nil
+	s.networkFee = nil
 	// Enable price updates
-	pricePause <- false
-	mpayHealthPause <- false
-
-	// Stop bill acceptor, enable QR code scanning
-	cmd(s.broker, "moneyacceptord", "stop")
-	cmd(s.broker, "codescannerd", "start")
+	s.notifyPrice = true
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/monero-atm/atm-backend/money"
+)
+
+// Cash to insert before the payout reaches the minimums, per currency of
+// the transaction. Inserting the amount of any one currency is enough.
+type belowMinimumData struct {
+	// Minor units
+	More map[string]int64 `json:"more"`
+	// Decimal amounts for display
+	Display map[string]string `json:"display"`
+}
+
+// Share of the fiat minimum the balance covers. Each currency counts
+// towards its own minimum, a currency without one always meets it.
+func (s *sessionData) fiatMinimumCovered() *big.Rat {
+	covered := new(big.Rat)
+	for c, balance := range s.fiatBalance {
+		if balance == 0 {
+			continue
+		}
+		min, ok := cfg.minFiat[c]
+		if !ok || min <= 0 {
+			return big.NewRat(1, 1)
+		}
+		covered.Add(covered, big.NewRat(balance, min))
+	}
+	return covered
+}
+
+// Cash of a currency, in minor units, that buys the XMR at the quoted price
+// after the fee. Tiers and the minimum fee are ignored.
+func (s *sessionData) cashFor(c string, xmr *big.Rat) (int64, error) {
+	price, err := money.Price(s.quote.Rates[c])
+	if err != nil {
+		return 0, newProtocolError(codeNoPrice, "no price for %s", c)
+	}
+	gross := new(big.Rat).Mul(xmr, price)
+	p, _ := new(big.Rat).SetString(strconv.FormatFloat(s.quote.Fees[c].Percent, 'f', -1, 64))
+	gross.Quo(gross, p.Sub(big.NewRat(1, 1), p))
+	return money.Minor(gross, currencyExponents[c], money.RoundUp)
+}
+
+// Refuse a payout below the minimum fiat amount or the minimum payout and
+// tell the frontend how much more to insert.
+func (s *sessionData) checkMinimum() error {
+	if !hasBalance(s.fiatBalance) {
+		// No funds, refused by the transition guard.
+		return nil
+	}
+	summary, err := s.summarize()
+	if err != nil {
+		return err
+	}
+
+	one := big.NewRat(1, 1)
+	missing := new(big.Rat).Sub(one, s.fiatMinimumCovered())
+	var missingXmr *big.Rat
+	if summary.Total < cfg.MinPayout {
+		missingXmr = money.FromPiconero(cfg.MinPayout - summary.Total)
+	}
+	if missing.Sign() <= 0 && missingXmr == nil {
+		return nil
+	}
+
+	data := belowMinimumData{More: make(map[string]int64), Display: make(map[string]string)}
+	for c, balance := range s.fiatBalance {
+		if balance == 0 {
+			continue
+		}
+		var more int64
+		if missing.Sign() > 0 {
+			// Already in minor units
+			min := new(big.Rat).SetInt64(cfg.minFiat[c])
+			more, err = money.Minor(new(big.Rat).Mul(missing, min), 0, money.RoundUp)
+			if err != nil {
+				return err
+			}
+		}
+		if missingXmr != nil {
+			moreXmr, err := s.cashFor(c, missingXmr)
+			if err != nil {
+				return err
+			}
+			if moreXmr > more {
+				more = moreXmr
+			}
+		}
+		data.More[c] = more
+		data.Display[c] = formatFiat(c, more)
+	}
+	if err := s.sendToFrontend(update{Event: eventBelowMinimum, Data: data}); err != nil {
+		return err
+	}
+
+	var parts []string
+	for c, d := range data.Display {
+		parts = append(parts, fmt.Sprintf("%s %s", d, c))
+	}
+	sort.Strings(parts)
+	return newProtocolError(codeBelowMinimum, "insert %s more", strings.Join(parts, " or "))
+}
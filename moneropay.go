@@ -3,7 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
@@ -14,11 +14,22 @@ import (
 	mpay "gitlab.com/moneropay/moneropay/v2/pkg/model"
 )
 
+// MoneroPay answered with an error, so the transfer definitely wasn't made.
+type mpayRefusedError struct {
+	msg string
+}
+
+func (e *mpayRefusedError) Error() string {
+	return e.msg
+}
+
 func mpayTransfer(amount uint64, address string) (*mpay.TransferPostResponse, error) {
 	endpoint, err := url.JoinPath(cfg.Moneropay, "/transfer")
 	if err != nil {
 		return nil, err
 	}
+	// Integrated addresses are passed as they are, the wallet attaches their
+	// payment ID to the transaction.
 	reqData := mpay.TransferPostRequest{
 		Destinations: []walletrpc.Destination{
 			{Amount: amount, Address: strings.TrimSpace(address)},
@@ -36,17 +47,22 @@ func mpayTransfer(amount uint64, address string) (*mpay.TransferPostResponse, er
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		var errResp mpay.ErrorResponse
 		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
 			return nil, err
 		}
-		return nil, errors.New(errResp.Message)
+		return nil, &mpayRefusedError{msg: errResp.Message}
 	}
 	var respData mpay.TransferPostResponse
 	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
 		return nil, err
 	}
+	// Whether it went through is unknown, reconciliation will tell.
+	if len(respData.TxHashList) == 0 {
+		return nil, fmt.Errorf("no transaction in MoneroPay response")
+	}
 	return &respData, nil
 }
 
@@ -72,29 +88,22 @@ func mpayHealth() (*mpay.HealthResponse, error) {
 }
 
 func mpayHealthPoll() {
-	pause := false
 	for {
-		select {
-		case p := <-mpayHealthPause:
-			pause = p
-		case <-time.After(cfg.MpayHealthPollFreq):
-			if !pause {
-				isHealthy := false
-				healthResp, err := mpayHealth()
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to get MoneroPay health status")
-				} else {
-					if healthResp.Status == 200 {
-						isHealthy = true
-					} else {
-						log.Info().Int("status", healthResp.Status).Msg("MoneroPay health is degraded")
-					}
-				}
-				if err := sendToFrontend(update{Event: "mpay_health", Data: isHealthy}); err != nil {
-					log.Error().Err(err).Msg("Failed to send MoneroPay health status update")
-				}
-				log.Info().Bool("healthy", isHealthy).Msg("Moneropay Update")
+		<-time.After(cfg.MpayHealthPollFreq)
+		isHealthy := false
+		healthResp, err := mpayHealth()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get MoneroPay health status")
+		} else {
+			if healthResp.Status == 200 {
+				isHealthy = true
+			} else {
+				log.Info().Int("status", healthResp.Status).Msg("MoneroPay health is degraded")
 			}
 		}
+		for _, s := range kiosks {
+			offer(s.healthEvent, isHealthy)
+		}
+		log.Info().Bool("healthy", isHealthy).Msg("Moneropay Update")
 	}
 }
@@ -0,0 +1,137 @@
+// Package money converts fiat to piconero without floating point errors.
+// Amounts are exact rationals until the final rounding to whole piconero.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Piconero in one XMR
+const PiconeroPerXmr = 1000000000000
+
+// How a converted amount is rounded to whole piconero
+type Rounding int
+
+const (
+	// Toward zero, in the operator's favor
+	RoundDown Rounding = iota
+	// Away from zero, in the customer's favor
+	RoundUp
+	// To the nearest piconero, halves to even
+	RoundHalfEven
+)
+
+var roundingNames = map[string]Rounding{
+	"down":      RoundDown,
+	"up":        RoundUp,
+	"half_even": RoundHalfEven,
+}
+
+func ParseRounding(s string) (Rounding, error) {
+	if s == "" {
+		return RoundDown, nil
+	}
+	r, ok := roundingNames[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown rounding %q", s)
+	}
+	return r, nil
+}
+
+var ErrInvalidPrice = errors.New("price must be a positive finite number")
+
+// Fiat amount in minor units of a currency with the given exponent, e.g.
+// 1234 with exponent 2 is 12.34.
+type Fiat struct {
+	Amount   int64
+	Exponent int
+}
+
+func (f Fiat) Rat() *big.Rat {
+	denom := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(f.Exponent)), nil)
+	return new(big.Rat).SetFrac(big.NewInt(f.Amount), denom)
+}
+
+// Exact price of one XMR in fiat major units. Floats are converted exactly,
+// so the same price always gives the same result.
+func Price(p float64) (*big.Rat, error) {
+	if p <= 0 || math.IsInf(p, 0) || math.IsNaN(p) {
+		return nil, ErrInvalidPrice
+	}
+	return new(big.Rat).SetFloat64(p), nil
+}
+
+// Exact XMR value of a fiat amount at the given price.
+func Xmr(f Fiat, price *big.Rat) (*big.Rat, error) {
+	if price == nil || price.Sign() <= 0 {
+		return nil, ErrInvalidPrice
+	}
+	return new(big.Rat).Quo(f.Rat(), price), nil
+}
+
+// Round a non-negative rational to an integer.
+func round(x *big.Rat, mode Rounding) (*big.Int, error) {
+	if x.Sign() < 0 {
+		return nil, errors.New("negative amount")
+	}
+	q, r := new(big.Int).QuoRem(x.Num(), x.Denom(), new(big.Int))
+	if r.Sign() != 0 {
+		switch mode {
+		case RoundUp:
+			q.Add(q, big.NewInt(1))
+		case RoundHalfEven:
+			// Compare twice the remainder with the denominator.
+			c := new(big.Int).Lsh(r, 1).Cmp(x.Denom())
+			if c > 0 || (c == 0 && q.Bit(0) == 1) {
+				q.Add(q, big.NewInt(1))
+			}
+		}
+	}
+	return q, nil
+}
+
+// Round an exact XMR amount to piconero. Round only once, after summing, so
+// the result never exceeds the quoted value by more than the rounding mode
+// allows.
+func Piconero(xmr *big.Rat, mode Rounding) (uint64, error) {
+	pico := new(big.Rat).Mul(xmr, new(big.Rat).SetInt64(PiconeroPerXmr))
+	q, err := round(pico, mode)
+	if err != nil {
+		return 0, err
+	}
+	if !q.IsUint64() {
+		return 0, errors.New("amount out of range")
+	}
+	return q.Uint64(), nil
+}
+
+// Exact XMR amount of piconero
+func FromPiconero(pico uint64) *big.Rat {
+	return new(big.Rat).SetFrac(new(big.Int).SetUint64(pico), big.NewInt(PiconeroPerXmr))
+}
+
+// Round an amount in major units to minor units of a currency with the given
+// exponent.
+func Minor(major *big.Rat, exponent int, mode Rounding) (int64, error) {
+	denom := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)
+	q, err := round(new(big.Rat).Mul(major, new(big.Rat).SetInt(denom)), mode)
+	if err != nil {
+		return 0, err
+	}
+	if !q.IsInt64() {
+		return 0, errors.New("amount out of range")
+	}
+	return q.Int64(), nil
+}
+
+// Parse a decimal XMR amount such as "0.001" to piconero, rounding up.
+func ParseXmr(s string) (uint64, error) {
+	xmr, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid XMR amount %q", s)
+	}
+	return Piconero(xmr, RoundUp)
+}
@@ -0,0 +1,152 @@
+package money
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+	"testing/quick"
+)
+
+// Random conversion inputs within the range an ATM sees
+type conversion struct {
+	Fiat  Fiat
+	Price float64
+}
+
+func newConversion(amount uint32, exponent uint8, price uint32) conversion {
+	return conversion{
+		Fiat:  Fiat{Amount: int64(amount % 100000000), Exponent: int(exponent % 4)},
+		Price: 1 + float64(price)/1000,
+	}
+}
+
+func (c conversion) exact(t *testing.T) *big.Rat {
+	price, err := Price(c.Price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmr, err := Xmr(c.Fiat, price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return xmr
+}
+
+func (c conversion) piconero(t *testing.T, mode Rounding) uint64 {
+	pico, err := Piconero(c.exact(t), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pico
+}
+
+func TestRoundDownNeverExceedsQuote(t *testing.T) {
+	onePico := FromPiconero(1)
+	f := func(amount uint32, exponent uint8, price uint32) bool {
+		c := newConversion(amount, exponent, price)
+		exact := c.exact(t)
+		down := FromPiconero(c.piconero(t, RoundDown))
+		if down.Cmp(exact) > 0 {
+			return false
+		}
+		// Less than a piconero is lost.
+		return new(big.Rat).Sub(exact, down).Cmp(onePico) < 0
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundUpCoversQuote(t *testing.T) {
+	f := func(amount uint32, exponent uint8, price uint32) bool {
+		c := newConversion(amount, exponent, price)
+		return FromPiconero(c.piconero(t, RoundUp)).Cmp(c.exact(t)) >= 0
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConversionIsDeterministic(t *testing.T) {
+	f := func(amount uint32, exponent uint8, price uint32, mode uint8) bool {
+		c := newConversion(amount, exponent, price)
+		m := Rounding(mode % 3)
+		return c.piconero(t, m) == c.piconero(t, m)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundHalfEvenTies(t *testing.T) {
+	f := func(n uint32) bool {
+		// Exactly n + 1/2 piconero
+		half := new(big.Rat).SetFrac(big.NewInt(2*int64(n)+1), big.NewInt(2*PiconeroPerXmr))
+		got, err := Piconero(half, RoundHalfEven)
+		if err != nil {
+			return false
+		}
+		want := uint64(n)
+		if n%2 == 1 {
+			want++
+		}
+		return got == want && got%2 == 0
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPiconeroRoundTrip(t *testing.T) {
+	f := func(pico uint64, mode uint8) bool {
+		got, err := Piconero(FromPiconero(pico), Rounding(mode%3))
+		return err == nil && got == pico
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseXmrRoundTrip(t *testing.T) {
+	f := func(pico uint64) bool {
+		s := fmt.Sprintf("%d.%012d", pico/PiconeroPerXmr, pico%PiconeroPerXmr)
+		got, err := ParseXmr(s)
+		return err == nil && got == pico && FromPiconero(got).Cmp(FromPiconero(pico)) == 0
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMinorRoundTrip(t *testing.T) {
+	f := func(amount int64, exponent uint8, mode uint8) bool {
+		fiat := Fiat{Amount: amount, Exponent: int(exponent % 4)}
+		if amount < 0 {
+			fiat.Amount = -(amount + 1)
+		}
+		got, err := Minor(fiat.Rat(), fiat.Exponent, Rounding(mode%3))
+		return err == nil && got == fiat.Amount
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseRounding(t *testing.T) {
+	for s, want := range map[string]Rounding{"": RoundDown, "down": RoundDown, "up": RoundUp, "half_even": RoundHalfEven} {
+		if got, err := ParseRounding(s); err != nil || got != want {
+			t.Errorf("ParseRounding(%q) = %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParseRounding("nearest"); err == nil {
+		t.Error("unknown rounding accepted")
+	}
+}
+
+func TestInvalidPrice(t *testing.T) {
+	for _, p := range []float64{0, -1} {
+		if _, err := Price(p); err != ErrInvalidPrice {
+			t.Errorf("Price(%v) = %v", p, err)
+		}
+	}
+}
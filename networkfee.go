@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gitlab.com/moneropay/go-monero/walletrpc"
+)
+
+// Who pays the Monero network fee of a payout
+const (
+	// The operator, the customer gets the full amount
+	networkFeeAbsorb = "absorb"
+	// The customer, it's deducted from the payout
+	networkFeeDeduct = "deduct"
+)
+
+// Ask wallet-rpc what sending the amount would cost, without relaying the
+// transaction. MoneroPay uses the same wallet, so the fee should match
+// closely.
+func dryRunTransfer(address string, amount uint64) (uint64, error) {
+	if cfg.WalletRpc == "" {
+		return 0, newProtocolError(codeWalletUnconfigured, "wallet RPC isn't configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.MpayTimeout)
+	defer cancel()
+	wallet := walletrpc.New(walletrpc.Config{Address: cfg.WalletRpc})
+	var resp walletrpc.TransferResponse
+	if err := wallet.Do(ctx, "transfer", &walletrpc.TransferRequest{
+		Destinations: []walletrpc.Destination{
+			{Amount: amount, Address: strings.TrimSpace(address)},
+		},
+		DoNotRelay: true,
+	}, &resp); err != nil {
+		return 0, newProtocolError(codeWalletUnavailable, "wallet RPC: %s", err)
+	}
+	return resp.Fee, nil
+}
+
+// Estimate the network fee of the payout once per transaction. Falls back
+// to the configured estimate when the wallet can't be asked.
+func (s *sessionData) estimateNetworkFee() {
+	if s.networkFee != nil || s.address == "" || !hasBalance(s.fiatBalance) {
+		return
+	}
+	fee := cfg.NetworkFeeFallback
+	// Estimate for the gross amount, the fee barely depends on it.
+	summary, err := s.summarize()
+	if err == nil {
+		var estimate uint64
+		if estimate, err = dryRunTransfer(s.address, summary.Gross); err == nil {
+			fee = estimate
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("fallback", walletrpc.XMRToDecimal(fee)).
+			Msg("Failed to estimate network fee")
+	}
+	s.networkFee = &fee
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const openAliasPrefix = "oa1:xmr "
+
+// OpenAlias a scanned address was resolved from
+type openAliasInfo struct {
+	Name string `json:"name"`
+	// The resolver reported the record as DNSSEC validated. Without it the
+	// address may have been spoofed, with it too unless the resolver is
+	// trusted and local.
+	Dnssec bool `json:"dnssec"`
+}
+
+// Whether the scan is an OpenAlias like donate.example.org or
+// donate@example.org rather than an address, which never has dots.
+func openAliasName(s string) (string, bool) {
+	name := strings.Replace(strings.ToLower(s), "@", ".", 1)
+	if !strings.Contains(name, ".") || len(name) > 253 {
+		return "", false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 || strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// Resolve an OpenAlias to the URI its XMR record amounts to.
+func resolveOpenAlias(name string) (*moneroUri, error) {
+	records, authenticated, err := lookupTxt(name)
+	if err != nil {
+		return nil, newProtocolError(codeOpenAliasFailed, "resolving %s: %s", name, err)
+	}
+	var found []string
+	for _, r := range records {
+		if strings.HasPrefix(r, openAliasPrefix) {
+			found = append(found, r)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, newProtocolError(codeOpenAliasFailed, "%s has no XMR OpenAlias record", name)
+	case 1:
+	default:
+		return nil, newProtocolError(codeOpenAliasFailed, "%s has several XMR OpenAlias records", name)
+	}
+	if !authenticated && cfg.OpenAliasRequireDnssec {
+		return nil, newProtocolError(codeOpenAliasInsecure, "%s isn't DNSSEC validated", name)
+	}
+
+	u := &moneroUri{OpenAlias: &openAliasInfo{Name: name, Dnssec: authenticated}}
+	for _, field := range strings.Split(strings.TrimPrefix(found[0], openAliasPrefix), ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "recipient_address":
+			u.Address = value
+		case "recipient_name":
+			u.RecipientName = value
+		case "tx_description":
+			u.Description = value
+		case "tx_payment_id":
+			u.PaymentId = strings.ToLower(value)
+		}
+	}
+	if u.Address == "" {
+		return nil, newProtocolError(codeOpenAliasFailed, "%s has no recipient_address", name)
+	}
+	log.Info().Str("alias", name).Str("address", u.Address).Bool("dnssec", authenticated).
+		Msg("Resolved OpenAlias")
+	return u, nil
+}
+
+// Resolver for OpenAlias lookups, the system's first nameserver by default
+func openAliasResolver() string {
+	if cfg.OpenAliasResolver != "" {
+		return cfg.OpenAliasResolver
+	}
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// Look up TXT records with the DNSSEC OK bit set and report whether the
+// resolver authenticated them. That's only the resolver's word, the AD bit
+// isn't protected on its way here. Truncated answers are retried over TCP.
+func lookupTxt(name string) ([]string, bool, error) {
+	q, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, false, err
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, false, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               binary.BigEndian.Uint16(id[:]),
+		RecursionDesired: true,
+		AuthenticData:    true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: q, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, false, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, false, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, false, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, false, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err := exchangeDns("udp", query)
+	if err != nil {
+		return nil, false, err
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, false, err
+	}
+	if h.Truncated {
+		if resp, err = exchangeDns("tcp", query); err != nil {
+			return nil, false, err
+		}
+		if h, err = p.Start(resp); err != nil {
+			return nil, false, err
+		}
+	}
+	if h.ID != binary.BigEndian.Uint16(id[:]) {
+		return nil, false, fmt.Errorf("DNS response ID mismatch")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, false, fmt.Errorf("DNS error: %s", h.RCode)
+	}
+	// A spoofed answer would have to guess the question along with the ID.
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(questions) != 1 || !strings.EqualFold(questions[0].Name.String(), q.String()) ||
+		questions[0].Type != dnsmessage.TypeTXT || questions[0].Class != dnsmessage.ClassINET {
+		return nil, false, fmt.Errorf("DNS response doesn't answer the question")
+	}
+	var records []string
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if ah.Type != dnsmessage.TypeTXT {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		txt, err := p.TXTResource()
+		if err != nil {
+			return nil, false, err
+		}
+		records = append(records, strings.Join(txt.TXT, ""))
+	}
+	return records, h.AuthenticData, nil
+}
+
+func exchangeDns(network string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, openAliasResolver(), cfg.OpenAliasTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(cfg.OpenAliasTimeout))
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	// Messages over TCP are prefixed with their length.
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
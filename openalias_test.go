@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Nameserver answering every TXT query with the same records, over UDP and
+// TCP on the same port of 127.0.0.1.
+type dnsStub struct {
+	records []string
+	// Set the AD bit, as a validating resolver would
+	authenticated bool
+	// Answer UDP queries with the TC bit and no records
+	truncate bool
+	// Answer with a different ID than the query's
+	wrongId bool
+	// Answer another question than the query's
+	wrongName bool
+
+	udpQueries atomic.Int32
+	tcpQueries atomic.Int32
+}
+
+func (d *dnsStub) start(t *testing.T) {
+	t.Helper()
+	var udp net.PacketConn
+	var tcp net.Listener
+	// The TCP port may be taken even though the UDP one was free.
+	for i := 0; tcp == nil; i++ {
+		var err error
+		if udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		tcp, err = net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			d.udpQueries.Add(1)
+			if resp, err := d.answer(buf[:n], d.truncate); err == nil {
+				udp.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			d.tcpQueries.Add(1)
+			var l [2]byte
+			if _, err := io.ReadFull(conn, l[:]); err == nil {
+				query := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(conn, query); err == nil {
+					if resp, err := d.answer(query, false); err == nil {
+						conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+					}
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	cfg.OpenAliasResolver = udp.LocalAddr().String()
+	cfg.OpenAliasTimeout = 2 * time.Second
+	t.Cleanup(func() { cfg.OpenAliasResolver = "" })
+}
+
+func (d *dnsStub) answer(query []byte, truncated bool) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	if d.wrongId {
+		h.ID++
+	}
+	if d.wrongName {
+		q.Name = dnsmessage.MustNewName("attacker.example.")
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               h.ID,
+		Response:         true,
+		RecursionDesired: h.RecursionDesired,
+		Truncated:        truncated,
+		AuthenticData:    d.authenticated,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if !truncated {
+		for _, r := range d.records {
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 300}
+			if err := b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{r}}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.Finish()
+}
+
+const testOpenAliasRecord = "oa1:xmr recipient_address=" + testAddress +
+	"; recipient_name=Monero Development Fund; tx_description=Donation"
+
+func TestOpenAlias(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		stub          *dnsStub
+		requireDnssec bool
+		// Expected error code, empty when the alias resolves
+		code string
+		tcp  bool
+	}{
+		{name: "authenticated", stub: &dnsStub{records: []string{testOpenAliasRecord}, authenticated: true}},
+		{name: "unauthenticated", stub: &dnsStub{records: []string{testOpenAliasRecord}}},
+		{name: "other_records", stub: &dnsStub{records: []string{"v=spf1 -all", testOpenAliasRecord, "oa1:btc recipient_address=x"}}},
+		{name: "truncated", stub: &dnsStub{records: []string{testOpenAliasRecord}, authenticated: true, truncate: true}, tcp: true},
+		{name: "wrong_id", stub: &dnsStub{records: []string{testOpenAliasRecord}, wrongId: true}, code: codeOpenAliasFailed},
+		{name: "wrong_question", stub: &dnsStub{records: []string{testOpenAliasRecord}, wrongName: true}, code: codeOpenAliasFailed},
+		{name: "several", stub: &dnsStub{records: []string{testOpenAliasRecord, testOpenAliasRecord}}, code: codeOpenAliasFailed},
+		{name: "none", stub: &dnsStub{records: []string{"v=spf1 -all"}}, code: codeOpenAliasFailed},
+		{name: "no_address", stub: &dnsStub{records: []string{"oa1:xmr recipient_name=Nobody"}}, code: codeOpenAliasFailed},
+		{name: "require_dnssec", stub: &dnsStub{records: []string{testOpenAliasRecord}, authenticated: true}, requireDnssec: true},
+		{name: "require_dnssec_unauthenticated", stub: &dnsStub{records: []string{testOpenAliasRecord}}, requireDnssec: true,
+			code: codeOpenAliasInsecure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.stub.start(t)
+			cfg.OpenAliasRequireDnssec = tc.requireDnssec
+			t.Cleanup(func() { cfg.OpenAliasRequireDnssec = false })
+
+			u, err := resolveOpenAlias("donate.getmonero.org")
+			if tc.code != "" {
+				if err == nil {
+					t.Fatalf("expected %s, got no error", tc.code)
+				}
+				if code := errorCode(err); code != tc.code {
+					t.Fatalf("expected %s, got %s: %v", tc.code, code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Address != testAddress || u.RecipientName != "Monero Development Fund" || u.Description != "Donation" {
+				t.Errorf("unexpected URI %+v", u)
+			}
+			if u.OpenAlias.Name != "donate.getmonero.org" || u.OpenAlias.Dnssec != tc.stub.authenticated {
+				t.Errorf("unexpected OpenAlias info %+v", u.OpenAlias)
+			}
+			if tcp := tc.stub.tcpQueries.Load() > 0; tcp != tc.tcp {
+				t.Errorf("queried over TCP: %v, want %v", tcp, tc.tcp)
+			}
+			if tc.stub.udpQueries.Load() != 1 {
+				t.Errorf("%d UDP queries, want 1", tc.stub.udpQueries.Load())
+			}
+		})
+	}
+}
+
+func TestOpenAliasName(t *testing.T) {
+	for s, want := range map[string]string{
+		"donate.getmonero.org":           "donate.getmonero.org",
+		"donate@getmonero.org":           "donate.getmonero.org",
+		"Donate.GetMonero.org.":          "donate.getmonero.org.",
+		testAddress:                      "",
+		"bad..name":                      "",
+		"bad name.org":                   "",
+		strings.Repeat("a", 64) + ".org": "",
+	} {
+		got, ok := openAliasName(s)
+		if got != want || ok != (want != "") {
+			t.Errorf("openAliasName(%q) = %q, %v, want %q", s, got, ok, want)
+		}
+	}
+}
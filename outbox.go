@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+)
+
+// Most updates kept for a detached frontend. The oldest are dropped first.
+const outboxSize = 256
+
+// Queue of updates to a kiosk's frontend. Updates survive reconnects, a
+// message whose write failed is sent again to the next connection.
+type outbox struct {
+	mu    sync.Mutex
+	queue [][]byte
+	// Connection whose writer drains the queue, nil while detached. Writers
+	// of replaced connections may still be winding down.
+	owner *frontendConn
+	// Signalled when the queue becomes non-empty
+	ready chan struct{}
+}
+
+func newOutbox() *outbox {
+	return &outbox{ready: make(chan struct{}, 1)}
+}
+
+// Transient updates like prices are only worth sending to a connected
+// frontend, the state snapshot on resume covers them otherwise.
+func (o *outbox) push(m []byte, transient bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if transient && o.owner == nil {
+		return
+	}
+	if len(o.queue) == outboxSize {
+		o.queue = o.queue[1:]
+	}
+	o.queue = append(o.queue, m)
+	o.signal()
+}
+
+// Must be called with the lock held.
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Next message for the connection's writer. Nothing is handed to a writer
+// whose connection was replaced.
+func (o *outbox) pop(c *frontendConn) ([]byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.owner != c || len(o.queue) == 0 {
+		return nil, false
+	}
+	m := o.queue[0]
+	o.queue = o.queue[1:]
+	return m, true
+}
+
+// Put back a message that couldn't be written.
+func (o *outbox) unpop(m []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queue = append([][]byte{m}, o.queue...)
+}
+
+func (o *outbox) attach(c *frontendConn) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.owner = c
+	o.signal()
+}
+
+// Detach an exiting writer. Only the current connection detaches the
+// outbox, and the signal is passed on in case the exiting writer took it.
+func (o *outbox) detach(c *frontendConn) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.owner == c {
+		o.owner = nil
+	}
+	if len(o.queue) > 0 {
+		o.signal()
+	}
+}
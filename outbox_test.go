@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestOutboxReplacedWriter(t *testing.T) {
+	o := newOutbox()
+	old := &frontendConn{done: make(chan struct{})}
+	cur := &frontendConn{done: make(chan struct{})}
+	o.attach(old)
+	o.attach(cur)
+
+	// The old writer exits after the new one attached.
+	<-o.ready
+	o.push([]byte("queued"), false)
+	<-o.ready
+	o.detach(old)
+
+	o.push([]byte("price"), true)
+	if _, ok := o.pop(old); ok {
+		t.Fatal("replaced writer got a message")
+	}
+	select {
+	case <-o.ready:
+	default:
+		t.Fatal("signal wasn't passed on by the exiting writer")
+	}
+	for _, want := range []string{"queued", "price"} {
+		m, ok := o.pop(cur)
+		if !ok || string(m) != want {
+			t.Fatalf("expected %q, got %q", want, m)
+		}
+	}
+
+	o.detach(cur)
+	o.push([]byte("price"), true)
+	if len(o.queue) != 0 {
+		t.Fatal("transient message kept while detached")
+	}
+}
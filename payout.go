@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gitlab.com/moneropay/go-monero/walletrpc"
+)
+
+type payoutStatus int
+
+const (
+	// Not attempted yet, nothing to reconcile
+	payoutNew payoutStatus = iota
+	payoutPending
+	payoutSent
+	payoutFailed
+	payoutUnknown
+)
+
+// A single payout attempt. The ID is the session ID, so retries of the same
+// session always refer to the same payout and the same amount.
+type payout struct {
+	Id      string    `json:"id"`
+	Address string    `json:"address"`
+	Xmr     uint64    `json:"xmr"`
+	Created time.Time `json:"created"`
+	status  payoutStatus
+	tx      string
+	// Realized network fee
+	fee uint64
+}
+
+type payoutFailedData struct {
+	Id     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+type payoutEventData struct {
+	Id     string `json:"id"`
+	Amount string `json:"amount"`
+	Tx     string `json:"tx,omitempty"`
+	Code   string `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Outgoing transfer as returned by wallet-rpc's get_transfers. The library
+// type lacks the destinations.
+type walletTransfer struct {
+	Txid         string                  `json:"txid"`
+	Amount       uint64                  `json:"amount"`
+	Fee          uint64                  `json:"fee"`
+	PaymentId    string                  `json:"payment_id"`
+	Timestamp    uint64                  `json:"timestamp"`
+	Destinations []walletrpc.Destination `json:"destinations"`
+}
+
+type walletTransfers struct {
+	Out     []walletTransfer `json:"out"`
+	Pending []walletTransfer `json:"pending"`
+	Pool    []walletTransfer `json:"pool"`
+}
+
+type txSet struct {
+	mu  sync.Mutex
+	txs map[string]bool
+}
+
+// Transactions already credited to a finished payout. Reconciliation never
+// attributes these to another payout.
+var paidTxs = &txSet{txs: make(map[string]bool)}
+
+func (t *txSet) add(tx string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.txs[tx] = true
+}
+
+func (t *txSet) has(tx string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.txs[tx]
+}
+
+func (p *payout) eventData() payoutEventData {
+	return payoutEventData{
+		Id:     p.Id,
+		Amount: walletrpc.XMRToDecimal(p.Xmr),
+		Tx:     p.tx,
+	}
+}
+
+// Look for the payout in the wallet's transfer history. Whether the transfer
+// is considered failed or unknown when missing depends on how long ago it
+// was attempted, since MoneroPay may still be working on it.
+func reconcilePayout(p *payout) error {
+	if cfg.WalletRpc == "" {
+		p.status = payoutUnknown
+		return newProtocolError(codeWalletUnconfigured, "wallet RPC isn't configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.MpayTimeout)
+	defer cancel()
+	wallet := walletrpc.New(walletrpc.Config{Address: cfg.WalletRpc})
+	var resp walletTransfers
+	if err := wallet.Do(ctx, "get_transfers", &walletrpc.GetTransfersRequest{
+		Out: true, Pending: true, Pool: true,
+	}, &resp); err != nil {
+		p.status = payoutUnknown
+		return newProtocolError(codeWalletUnavailable, "wallet RPC: %s", err)
+	}
+
+	// Allow for some clock drift between us and the wallet.
+	since := p.Created.Add(-time.Minute).Unix()
+	for _, list := range [][]walletTransfer{resp.Out, resp.Pending, resp.Pool} {
+		for _, t := range list {
+			if int64(t.Timestamp) < since || paidTxs.has(t.Txid) {
+				continue
+			}
+			for _, d := range t.Destinations {
+				if sameDestination(p.Address, d, t.PaymentId) && d.Amount == p.Xmr {
+					p.status = payoutSent
+					p.tx = t.Txid
+					p.fee = t.Fee
+					return nil
+				}
+			}
+		}
+	}
+
+	if time.Since(p.Created) < cfg.PayoutSettleTime {
+		p.status = payoutUnknown
+		return newProtocolError(codeTransferNotFoundYet, "transfer not found yet")
+	}
+	p.status = payoutFailed
+	return nil
+}
+
+// Pay out the current session exactly once. A payout that may already have
+// gone through, i.e. an earlier attempt or one restored from the journal, is
+// reconciled before anything is sent again.
+func (s *sessionData) executePayout() {
+	p := s.payout
+	if p.status == payoutPending || p.status == payoutUnknown {
+		s.reconcile()
+		if p.status != payoutFailed {
+			return
+		}
+	}
+
+	p.Created = time.Now()
+	p.status = payoutPending
+	p.tx = ""
+	p.fee = 0
+	journ.record(s.id, journalPayoutPending, p)
+	if err := s.sendToFrontend(update{Event: eventPayoutPending, Data: p.eventData()}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+
+	s.tx, s.err = mpayTransfer(p.Xmr, p.Address)
+	if s.err == nil {
+		p.status = payoutSent
+		p.tx = s.tx.TxHashList[0]
+		p.fee = s.tx.Fee
+		s.finishPayout()
+		return
+	}
+	log.Error().Err(s.err).Str("payout", p.Id).Msg("Failed to transfer")
+
+	var refused *mpayRefusedError
+	if errors.As(s.err, &refused) {
+		p.status = payoutFailed
+		journ.record(s.id, journalPayoutFailed, payoutFailedData{Id: p.Id, Reason: s.err.Error()})
+		data := p.eventData()
+		data.Code = codePayoutRefused
+		data.Reason = s.err.Error()
+		if err := s.sendToFrontend(update{Event: eventPayoutFailed, Data: data}); err != nil {
+			log.Error().Err(err).Msg("Failed to send to frontend")
+		}
+		return
+	}
+
+	// Timed out or the response got lost, MoneroPay may have sent it.
+	s.reconcile()
+}
+
+// Reconcile the pending payout and tell the frontend about the outcome.
+func (s *sessionData) reconcile() {
+	p := s.payout
+	err := reconcilePayout(p)
+	data := p.eventData()
+	switch p.status {
+	case payoutSent:
+		log.Info().Str("payout", p.Id).Str("tx", p.tx).Msg("Reconciled payout as sent")
+		if err := s.sendToFrontend(update{Event: eventPayoutSent, Data: data}); err != nil {
+			log.Error().Err(err).Msg("Failed to send to frontend")
+		}
+		s.finishPayout()
+	case payoutFailed:
+		log.Info().Str("payout", p.Id).Msg("Reconciled payout as not sent")
+		journ.record(s.id, journalPayoutFailed, payoutFailedData{Id: p.Id, Reason: "not found in wallet"})
+		data.Code = codePayoutNotFound
+		data.Reason = "not found in wallet"
+		if err := s.sendToFrontend(update{Event: eventPayoutFailed, Data: data}); err != nil {
+			log.Error().Err(err).Msg("Failed to send to frontend")
+		}
+	case payoutUnknown:
+		log.Warn().Err(err).Str("payout", p.Id).Msg("Payout outcome is unknown")
+		journ.record(s.id, journalPayoutUnknown, payoutFailedData{Id: p.Id, Reason: err.Error()})
+		data.Code = errorCode(err)
+		data.Reason = err.Error()
+		if err := s.sendToFrontend(update{Event: eventPayoutUnknown, Data: data}); err != nil {
+			log.Error().Err(err).Msg("Failed to send to frontend")
+		}
+	}
+}
+
+func (s *sessionData) finishPayout() {
+	p := s.payout
+	paidTxs.add(p.tx)
+	journ.record(s.id, journalPaid, journalPaidData{Tx: p.tx, Xmr: p.Xmr, Fee: p.fee})
+	creditLedger(s.id, p.Address, s.fiatBalance)
+	xmrString := walletrpc.XMRToDecimal(p.Xmr)
+	log.Info().Str("amount", xmrString).Str("address", p.Address).
+		Str("network_fee", walletrpc.XMRToDecimal(p.fee)).Msg("Sent XMR")
+	if err := s.sendToFrontend(update{
+		Event: eventTxinfo, Data: txinfoData{
+			Tx:         p.tx,
+			Amount:     xmrString,
+			Summary:    s.summary,
+			NetworkFee: walletrpc.XMRToDecimal(p.fee),
+		},
+	}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+	if err := s.fire(evPaid); err != nil {
+		log.Error().Err(err).Msg("Failed to finish transaction")
+	}
+	log.Info().Msg("Finalized transaction")
+}
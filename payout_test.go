@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mpay "gitlab.com/moneropay/moneropay/v2/pkg/model"
+)
+
+// MoneroPay answering transfers with resp, counting them.
+func mpayStub(t *testing.T, resp mpay.TransferPostResponse) *int {
+	t.Helper()
+	calls := new(int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/transfer" {
+			http.NotFound(w, r)
+			return
+		}
+		*calls++
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	cfg.Moneropay = srv.URL
+	cfg.MpayTimeout = time.Second
+	cfg.WalletRpc = ""
+	return calls
+}
+
+func TestFirstPayout(t *testing.T) {
+	calls := mpayStub(t, mpay.TransferPostResponse{Amount: 1e12, Fee: 3e7, TxHashList: []string{"tx"}})
+	s, _, _ := testSession(t, TxInfo)
+	s.payout = &payout{Id: s.id, Address: testAddress, Xmr: 1e12}
+	s.executePayout()
+	if *calls != 1 {
+		t.Fatalf("transfer called %d times, want 1", *calls)
+	}
+	if s.payout.status != payoutSent || s.payout.tx != "tx" {
+		t.Fatalf("payout is %d with tx %q, want sent with tx", s.payout.status, s.payout.tx)
+	}
+	if s.state != Idle {
+		t.Fatalf("state %s, want %s", s.state, Idle)
+	}
+}
+
+func TestPayoutWithoutTx(t *testing.T) {
+	calls := mpayStub(t, mpay.TransferPostResponse{Amount: 1e12})
+	s, _, _ := testSession(t, TxInfo)
+	s.payout = &payout{Id: s.id, Address: testAddress, Xmr: 1e12}
+	s.executePayout()
+	if *calls != 1 {
+		t.Fatalf("transfer called %d times, want 1", *calls)
+	}
+	if s.payout.status != payoutUnknown {
+		t.Fatalf("payout is %d, want unknown", s.payout.status)
+	}
+
+	// An uncertain payout isn't sent again without reconciliation.
+	s.executePayout()
+	if *calls != 1 {
+		t.Fatalf("transfer called %d times, want 1", *calls)
+	}
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"net/http"
+	"strings"
 	"time"
 
 	"github.com/monero-atm/pricefetcher"
@@ -10,85 +10,197 @@ import (
 )
 
 type xmrPrice struct {
+	// Including the default fee, for display
 	Amount float64 `json:"amount"`
 	Short  string  `json:"short"`
+	// Without any fee, quotes use this
+	Market float64   `json:"market"`
+	Path   pricePath `json:"path"`
+	// Where this price comes from, see the update's status
+	Status    string    `json:"status"`
+	FetchedAt time.Time `json:"fetched_at"`
 }
 
+// Where the prices of an update come from
+const (
+	// Fetched just now
+	priceLive = "live"
+	// Last known good prices, the sources are unreachable
+	priceCached = "cached"
+	// The operator's fallback rates
+	priceFallback = "fallback"
+	// Nothing usable, new transactions are refused
+	priceUnavailable = "unavailable"
+)
+
 type priceUpdate struct {
+	Status     string     `json:"status"`
 	Currencies []xmrPrice `json:"currencies"`
+	Source     string     `json:"source"`
+	// Per-source breakdown of the XMR pairs that were fetched
+	Pairs []aggregatePrice `json:"pairs"`
+	// When the oldest price used was fetched
+	FetchedAt time.Time `json:"fetched_at"`
+	// Currencies without any price, notes in them aren't accepted
+	Missing []string `json:"missing,omitempty"`
+	// Fiat rates used for currencies without an XMR pair
+	FiatRates *fiatRatesInfo `json:"fiat_rates,omitempty"`
 }
 
-// Only XMR/EUR and XMR/USD pairs are available. When another fiat currency is
-// specified, this function will calculate the value based on the daily rate
-// provided by European Central Bank. "fiatEurRate" contains this rate.
-// It's ignored when "currency" is set to EUR or USD.
-func getXmrPrice(currencies []string, fiatRates map[string]float64, fee float64) (priceUpdate, error) {
+// Get the XMR price of every currency along its price path, see
+// pricepath.go. Each pair is fetched once per poll. Currencies whose
+// price couldn't be found are returned with their error, the others are
+// live.
+func getXmrPrice(currencies []string, fee float64) (priceUpdate, map[string]error) {
 	var pu priceUpdate
+	rates, info := fiatRates.get()
+	pu.FiatRates = info
+	pu.Source = "median of " + strings.Join(cfg.PriceSources, ", ")
 
-	cl := &http.Client{Timeout: 5 * time.Second}
+	cl := newPriceClient()
 	fetcher := pricefetcher.New(cl)
-	// Get EUR rate
-	eurRate, source, err := fetcher.FetchXMRPrice("EUR")
-	if err != nil {
-		return pu, err
-	} else {
-		log.Info().Float64("rate", eurRate).Str("source", source).Msg("Got XMR/EUR rate")
+	pairs := make(map[string]float64)
+	pair := func(base, currency string) (float64, error) {
+		if price, ok := pairs[base+"/"+currency]; ok {
+			return price, nil
+		}
+		ap, err := fetchAggregate(fetcher, cl, base, currency)
+		pu.Pairs = append(pu.Pairs, ap)
+		if err != nil {
+			return 0, err
+		}
+		log.Info().Float64("rate", ap.Price).Str("base", base).Str("currency", currency).Msg("Got aggregated rate")
+		if pu.FetchedAt.IsZero() || ap.FetchedAt.Before(pu.FetchedAt) {
+			pu.FetchedAt = ap.FetchedAt
+		}
+		pairs[base+"/"+currency] = ap.Price
+		return ap.Price, nil
 	}
 
+	failed := make(map[string]error)
 	for _, c := range currencies {
-		var xp xmrPrice
-		if c == "USD" {
-			usdRate, source, err := fetcher.FetchXMRPrice("USD")
-			if err != nil {
-				return pu, err
-			} else {
-				log.Info().Float64("rate", usdRate).Str("source", source).Msg("Got XMR/USD rate")
-			}
-			xp.Amount = usdRate
-			xp.Short = c
-		} else if c == "EUR" {
-			xp.Amount = eurRate
-			xp.Short = "EUR"
-		} else {
-			if val, ok := fiatRates[c]; ok {
-				xp.Amount = eurRate * val
-				xp.Short = c
-			} else {
-				return pu, fmt.Errorf("ECB doesn't have a rate for this currency")
-			}
+		price, path, err := priceAlong(c, pair, rates, info)
+		if err != nil {
+			failed[c] = fmt.Errorf("%s via %s: %w", c, path.Path, err)
+			continue
 		}
-		xp.Amount *= (1 + fee)
+		xp := xmrPrice{Short: c, Market: price, Amount: price * (1 + fee), Path: path, Status: priceLive}
 		pu.Currencies = append(pu.Currencies, xp)
 	}
-	return pu, err
+	for i := range pu.Currencies {
+		pu.Currencies[i].FetchedAt = pu.FetchedAt
+	}
+	return pu, failed
 }
 
-func pricePoll(currencies []string, fiatRates map[string]float64, fee float64) {
-	pause := false
+// Price of a currency from the operator's fallback rates. A per-currency
+// rate takes precedence, otherwise the XMR/EUR fallback is crossed with the
+// fiat rates.
+func fallbackPrice(c string, rates map[string]float64, fee float64) (xmrPrice, bool) {
+	xp := xmrPrice{Short: c, Market: cfg.FallbackRates[c], Status: priceFallback, FetchedAt: time.Now()}
+	if xp.Market == 0 && cfg.FallbackRate > 0 {
+		if c == "EUR" {
+			xp.Market = cfg.FallbackRate
+		} else if val, ok := rates[c]; ok {
+			xp.Market = cfg.FallbackRate * val
+		}
+	}
+	if xp.Market <= 0 {
+		return xp, false
+	}
+	xp.Amount = xp.Market * (1 + fee)
+	xp.Path = pricePath{Path: pathFallback, Legs: []priceLeg{{Pair: "XMR/" + c, Rate: xp.Market, Source: "fallback"}}}
+	return xp, true
+}
 
-	// Fetch the price for the first time without the wait.
-	prices, err := getXmrPrice(currencies, fiatRates, fee)
+// Fill in the currencies without a live price, each from its last known
+// good price for a while, then from the fallback rates until
+// fallback_max_age into the outage. Currencies without either are listed as
+// missing. The update takes the status of its worst price and the time of
+// its oldest. Polling started at started, which is when the outage of a
+// currency that never had a price began.
+func degradePrices(pu priceUpdate, currencies []string, lastGood map[string]xmrPrice, started time.Time, fee float64) priceUpdate {
+	live := make(map[string]xmrPrice)
+	for _, xp := range pu.Currencies {
+		live[xp.Short] = xp
+	}
+	rates, _ := fiatRates.get()
+	pu.Currencies = nil
+	pu.Status = priceLive
+	rank := map[string]int{priceLive: 0, priceCached: 1, priceFallback: 2}
+	for _, c := range currencies {
+		xp, ok := live[c]
+		if !ok {
+			outage := started
+			lg, cached := lastGood[c]
+			if cached {
+				outage = lg.FetchedAt
+			}
+			if cached && time.Since(outage) < cfg.PriceCacheMaxAge {
+				xp, ok = lg, true
+				xp.Status = priceCached
+			} else if time.Since(outage) < cfg.FallbackMaxAge {
+				xp, ok = fallbackPrice(c, rates, fee)
+			}
+		}
+		if !ok {
+			pu.Missing = append(pu.Missing, c)
+			continue
+		}
+		if rank[xp.Status] > rank[pu.Status] {
+			pu.Status = xp.Status
+		}
+		if xp.Status != priceFallback && (pu.FetchedAt.IsZero() || xp.FetchedAt.Before(pu.FetchedAt)) {
+			pu.FetchedAt = xp.FetchedAt
+		}
+		pu.Currencies = append(pu.Currencies, xp)
+	}
+	if len(pu.Currencies) == 0 {
+		pu.Status = priceUnavailable
+	}
+	return pu
+}
 
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to get XMR price")
-	} else {
-		priceEvent <- prices
+// Whether quotes may be made at these prices
+func (pu *priceUpdate) usable() error {
+	maxAge := cfg.PriceMaxAge
+	switch pu.Status {
+	case priceUnavailable:
+		return newProtocolError(codePriceUnavailable, "no price available")
+	case priceFallback:
+		return nil
+	case priceCached:
+		maxAge = cfg.PriceCacheMaxAge
 	}
+	if age := time.Since(pu.FetchedAt); maxAge > 0 && age > maxAge {
+		return newProtocolError(codePriceStale, "price is %s old", age.Round(time.Second))
+	}
+	return nil
+}
 
+// Fetch prices periodically. A currency whose price can't be fetched uses
+// its last known good price for a while, then the fallback rates. Kiosks are
+// told prices are unavailable when no currency has one, until the sources
+// come back.
+func pricePoll(currencies []string, fee float64) {
+	lastGood := make(map[string]xmrPrice)
+	started := time.Now()
 	for {
-		select {
-		case p := <-pricePause:
-			pause = p
-		case <-time.After(cfg.PricePollFreq):
-			if !pause {
-				prices, err := getXmrPrice(currencies, fiatRates, fee)
-
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to get XMR price")
-				} else {
-					priceEvent <- prices
-				}
+		prices, failed := getXmrPrice(currencies, fee)
+		for _, xp := range prices.Currencies {
+			lastGood[xp.Short] = xp
+		}
+		prices.Status = priceLive
+		if len(failed) > 0 {
+			for _, err := range failed {
+				log.Error().Err(err).Msg("Failed to get XMR price")
 			}
+			prices = degradePrices(prices, currencies, lastGood, started, fee)
+			log.Warn().Str("status", prices.Status).Strs("missing", prices.Missing).Msg("Degraded pricing")
+		}
+		for _, s := range kiosks {
+			offer(s.priceEvent, prices)
 		}
+		<-time.After(cfg.PricePollFreq)
 	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDegradePrices(t *testing.T) {
+	cfg.PriceCacheMaxAge = time.Hour
+	cfg.FallbackRate = 0
+	cfg.FallbackRates = map[string]float64{"CZK": 3100}
+	cfg.FallbackMaxAge = time.Hour
+	t.Cleanup(func() {
+		cfg.FallbackRates = nil
+		cfg.FallbackMaxAge = 0
+	})
+
+	fetched := time.Now().Add(-time.Minute)
+	live := priceUpdate{Currencies: []xmrPrice{{Short: "EUR", Market: 150, Status: priceLive, FetchedAt: fetched}}}
+	lastGood := map[string]xmrPrice{
+		"EUR": live.Currencies[0],
+		"USD": {Short: "USD", Market: 160, Status: priceLive, FetchedAt: fetched.Add(-time.Minute)},
+		"GBP": {Short: "GBP", Market: 130, Status: priceLive, FetchedAt: fetched.Add(-2 * time.Hour)},
+	}
+
+	pu := degradePrices(live, []string{"EUR", "USD", "CZK", "GBP"}, lastGood, time.Now(), 0)
+	want := map[string]string{"EUR": priceLive, "USD": priceCached, "CZK": priceFallback}
+	if len(pu.Currencies) != len(want) {
+		t.Fatalf("got %d currencies, want %d", len(pu.Currencies), len(want))
+	}
+	for i, c := range []string{"EUR", "USD", "CZK"} {
+		xp := pu.Currencies[i]
+		if xp.Short != c || xp.Status != want[c] {
+			t.Errorf("currency %d is %s %s, want %s %s", i, xp.Short, xp.Status, c, want[c])
+		}
+	}
+	if !slices.Equal(pu.Missing, []string{"GBP"}) {
+		t.Errorf("missing %v, want [GBP]", pu.Missing)
+	}
+	if pu.Status != priceFallback {
+		t.Errorf("status %s, want %s", pu.Status, priceFallback)
+	}
+	if !pu.FetchedAt.Equal(lastGood["USD"].FetchedAt) {
+		t.Errorf("fetched at %v, want the cached USD price's %v", pu.FetchedAt, lastGood["USD"].FetchedAt)
+	}
+
+	pu = degradePrices(priceUpdate{}, []string{"GBP"}, lastGood, time.Now(), 0)
+	if pu.Status != priceUnavailable {
+		t.Errorf("status %s, want %s", pu.Status, priceUnavailable)
+	}
+
+	// The fallback runs out with fallback_max_age.
+	pu = degradePrices(priceUpdate{}, []string{"CZK"}, lastGood, time.Now().Add(-2*time.Hour), 0)
+	if pu.Status != priceUnavailable || !slices.Equal(pu.Missing, []string{"CZK"}) {
+		t.Errorf("status %s missing %v, want CZK unavailable", pu.Status, pu.Missing)
+	}
+}
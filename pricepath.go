@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How the XMR price of a currency is found
+const (
+	// XMR/<currency> market
+	pathDirect = "direct"
+	// XMR/EUR crossed with the fiat rate
+	pathEur = "eur"
+	// XMR/USD crossed with the fiat rates
+	pathUsd = "usd"
+	// XMR/BTC crossed with BTC/<currency>
+	pathBtc = "btc"
+	// The operator's fallback rate
+	pathFallback = "fallback"
+)
+
+const (
+	krakenBtcUrl        = "https://api.kraken.com/0/public/Ticker?pair=XBT%s"
+	coinGeckoBtcUrl     = "https://api.coingecko.com/api/v3/simple/price?ids=bitcoin&vs_currencies=%s"
+	cryptoCompareBtcUrl = "https://min-api.cryptocompare.com/data/price?fsym=BTC&tsyms=%s"
+	binanceBtcUrl       = "https://api.binance.com/api/v3/ticker/price?symbol=BTCUSDT"
+)
+
+// One rate the price was computed from
+type priceLeg struct {
+	Pair   string  `json:"pair"`
+	Rate   float64 `json:"rate"`
+	Source string  `json:"source"`
+}
+
+// Path taken to a currency's XMR price, recorded in quotes
+type pricePath struct {
+	Path string     `json:"path"`
+	Legs []priceLeg `json:"legs"`
+}
+
+// Path of a currency, EUR and USD have direct markets.
+func pathOf(c string) string {
+	if p, ok := cfg.PricePaths[c]; ok {
+		return p
+	}
+	if c == "EUR" || c == "USD" {
+		return pathDirect
+	}
+	return pathEur
+}
+
+// BTC price in a fiat currency from one source. The XMR/BTC leg is
+// aggregated like any XMR pair, and so is this one.
+func fetchBtcFromSource(cl *http.Client, source, currency string) (float64, error) {
+	c := strings.ToUpper(currency)
+	switch source {
+	case sourceKraken:
+		var resp struct {
+			Error  []string `json:"error"`
+			Result map[string]struct {
+				C []string `json:"c"`
+			} `json:"result"`
+		}
+		if err := getJson(cl, fmt.Sprintf(krakenBtcUrl, url.QueryEscape(c)), &resp); err != nil {
+			return 0, err
+		}
+		if len(resp.Error) > 0 {
+			return 0, fmt.Errorf("Kraken API error: %s", strings.Join(resp.Error, ", "))
+		}
+		for _, t := range resp.Result {
+			if len(t.C) > 0 {
+				return strconv.ParseFloat(t.C[0], 64)
+			}
+		}
+		return 0, fmt.Errorf("no BTC/%s price on Kraken", c)
+	case sourceCoinGecko:
+		var prices map[string]map[string]float64
+		if err := getJson(cl, fmt.Sprintf(coinGeckoBtcUrl, url.QueryEscape(strings.ToLower(c))), &prices); err != nil {
+			return 0, err
+		}
+		return prices["bitcoin"][strings.ToLower(c)], nil
+	case sourceCryptoCompare:
+		var prices map[string]float64
+		if err := getJson(cl, fmt.Sprintf(cryptoCompareBtcUrl, url.QueryEscape(c)), &prices); err != nil {
+			return 0, err
+		}
+		return prices[c], nil
+	case sourceBinance:
+		if c != "USD" {
+			return 0, fmt.Errorf("binance only quotes USDT")
+		}
+		var ticker struct {
+			Price string `json:"price"`
+		}
+		if err := getJson(cl, binanceBtcUrl, &ticker); err != nil {
+			return 0, err
+		}
+		return strconv.ParseFloat(ticker.Price, 64)
+	}
+	return 0, fmt.Errorf("unknown price source %q", source)
+}
+
+func getJson(cl *http.Client, u string, v interface{}) error {
+	resp, err := cl.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Cross rate of a currency from the EUR based fiat rates
+func fiatCross(rates map[string]float64, from, to string) (float64, error) {
+	rate := func(c string) (float64, error) {
+		if c == "EUR" {
+			return 1, nil
+		}
+		r, ok := rates[c]
+		if !ok || r <= 0 {
+			return 0, fmt.Errorf("no fiat rate for %s", c)
+		}
+		return r, nil
+	}
+	f, err := rate(from)
+	if err != nil {
+		return 0, err
+	}
+	t, err := rate(to)
+	if err != nil {
+		return 0, err
+	}
+	return t / f, nil
+}
+
+// Source name of the fiat rate used for a currency
+func fiatSource(info *fiatRatesInfo, c string) string {
+	if info == nil || c == "EUR" {
+		return ""
+	}
+	return info.Used[c]
+}
+
+// Price of a currency along its configured path. pair fetches an aggregated
+// XMR or BTC pair.
+func priceAlong(c string, pair func(base, currency string) (float64, error), rates map[string]float64,
+	info *fiatRatesInfo) (float64, pricePath, error) {
+	pp := pricePath{Path: pathOf(c)}
+	median := "median"
+	switch pp.Path {
+	case pathDirect:
+		xmr, err := pair("XMR", c)
+		if err != nil {
+			return 0, pp, err
+		}
+		pp.Legs = []priceLeg{{Pair: "XMR/" + c, Rate: xmr, Source: median}}
+		return xmr, pp, nil
+	case pathEur, pathUsd:
+		base := strings.ToUpper(pp.Path)
+		xmr, err := pair("XMR", base)
+		if err != nil {
+			return 0, pp, err
+		}
+		cross, err := fiatCross(rates, base, c)
+		if err != nil {
+			return 0, pp, err
+		}
+		source := fiatSource(info, c)
+		if base == "USD" {
+			source = fiatSource(info, "USD") + "," + source
+		}
+		pp.Legs = []priceLeg{
+			{Pair: "XMR/" + base, Rate: xmr, Source: median},
+			{Pair: base + "/" + c, Rate: cross, Source: source},
+		}
+		return xmr * cross, pp, nil
+	case pathBtc:
+		xmr, err := pair("XMR", "BTC")
+		if err != nil {
+			return 0, pp, err
+		}
+		btc, err := pair("BTC", c)
+		if err != nil {
+			return 0, pp, err
+		}
+		pp.Legs = []priceLeg{
+			{Pair: "XMR/BTC", Rate: xmr, Source: median},
+			{Pair: "BTC/" + c, Rate: btc, Source: median},
+		}
+		return xmr * btc, pp, nil
+	}
+	return 0, pp, fmt.Errorf("unknown price path %q", pp.Path)
+}
+
+// Requests are shared within a poll
+func newPriceClient() *http.Client {
+	return &http.Client{Timeout: 5 * time.Second}
+}
@@ -0,0 +1,238 @@
+package main
+
+//go:generate sh -c "go run . protocol schema > protocol.schema.json"
+//go:generate sh -c "go run . protocol doc > PROTOCOL.md"
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// Version of the websocket protocol between backend and frontend. Frontends
+// request it with the "atm.v<version>" websocket subprotocol. Connections
+// without a subprotocol get the current version.
+const protocolVersion = 1
+
+var supportedSubprotocols = []string{fmt.Sprintf("atm.v%d", protocolVersion)}
+
+// Events sent to the frontend. Events the frontend sends are listed in
+// fsm.go.
+const (
+	eventHello          = "hello"
+	eventPrice          = "price"
+	eventMpayHealth     = "mpay_health"
+	eventAddressin      = "addressin"
+	eventMoneyin        = "moneyin"
+	eventTxinfo         = "txinfo"
+	eventError          = "error"
+	eventRejected       = "rejected"
+	eventResumed        = "resumed"
+	eventPayoutPending  = "payout_pending"
+	eventPayoutSent     = "payout_sent"
+	eventPayoutFailed   = "payout_failed"
+	eventPayoutUnknown  = "payout_unknown"
+	eventAck            = "ack"
+	eventNack           = "nack"
+	eventSession        = "session"
+	eventState          = "state"
+	eventQuote          = "quote"
+	eventQuoteExpired   = "quote_expired"
+	eventSummary        = "summary"
+	eventAddressDetails = "address_details"
+	eventAddressFlagged = "address_flagged"
+	eventLimitReached   = "limit_reached"
+	eventBelowMinimum   = "below_minimum"
+	// Pricing went down or came back
+	eventPriceUnavailable = "price_unavailable"
+	eventPriceAvailable   = "price_available"
+)
+
+// Machine-readable error codes sent to the frontend.
+const (
+	codeInternal              = "internal"
+	codeMalformedMessage      = "malformed_message"
+	codeUnknownEvent          = "unknown_event"
+	codeDuplicate             = "duplicate"
+	codeBusy                  = "busy"
+	codeNoSession             = "no_session"
+	codeInvalidToken          = "invalid_token"
+	codeNoPrice               = "no_price"
+	codePriceStale            = "price_stale"
+	codePriceUnavailable      = "price_unavailable"
+	codeQuoteExpired          = "quote_expired"
+	codeIllegalTransition     = "illegal_transition"
+	codeNoAddress             = "no_address"
+	codeNoFunds               = "no_funds"
+	codeAddressAlreadyScanned = "address_already_scanned"
+	codeInvalidAddress        = "invalid_address"
+	codeWrongNetwork          = "wrong_network"
+	codeAddressEncoding       = "invalid_address_encoding"
+	codeAddressChecksum       = "address_checksum_mismatch"
+	codeUnknownAddressType    = "unknown_address_type"
+	codeAddressUnconfirmed    = "address_unconfirmed"
+	codeInvalidUri            = "invalid_uri"
+	codeOpenAliasFailed       = "openalias_failed"
+	codeOpenAliasInsecure     = "openalias_insecure"
+	codeAddressBlocked        = "address_blocked"
+	codeUnknownCurrency       = "unknown_currency"
+	codeCurrencyNotAllowed    = "currency_not_allowed"
+	codeLimitExceeded         = "limit_exceeded"
+	codeBelowMinimum          = "below_minimum"
+	codePayoutRefused         = "payout_refused"
+	codePayoutNotFound        = "payout_not_found"
+	codeWalletUnconfigured    = "wallet_unconfigured"
+	codeWalletUnavailable     = "wallet_unavailable"
+	codeTransferNotFoundYet   = "transfer_not_found_yet"
+)
+
+var errorCodes = []struct {
+	Code        string
+	Description string
+}{
+	{codeInternal, "Unexpected backend failure."},
+	{codeMalformedMessage, "The frontend message isn't valid JSON."},
+	{codeUnknownEvent, "The frontend sent an event that doesn't exist."},
+	{codeDuplicate, "The message was already handled within the duplicate window."},
+	{codeBusy, "The backend is busy, e.g. with a payout. The message was dropped."},
+	{codeNoSession, "There's no transaction to resume."},
+	{codeInvalidToken, "The session token doesn't match the transaction in progress."},
+	{codeNoPrice, "No XMR price is available to quote."},
+	{codePriceStale, "The XMR price is too old to quote, sources may be unreachable or disagree."},
+	{codePriceUnavailable, "No price source or fallback is available, new transactions are refused."},
+	{codeQuoteExpired, "The quote expired. Repeat the request to accept the new one."},
+	{codeIllegalTransition, "The event isn't allowed in the current state."},
+	{codeNoAddress, "No address has been scanned yet."},
+	{codeNoFunds, "No money has been inserted yet."},
+	{codeAddressAlreadyScanned, "The session already has an address."},
+	{codeInvalidAddress, "The scanned address has the wrong length or key size."},
+	{codeWrongNetwork, "The scanned address belongs to another Monero network."},
+	{codeAddressEncoding, "The scanned address isn't valid base58, e.g. it has a character Monero doesn't use."},
+	{codeAddressChecksum, "The scanned address's checksum doesn't match, it was likely mistyped or misread."},
+	{codeUnknownAddressType, "The scanned address has an unknown network byte, it's not a Monero address."},
+	{codeAddressUnconfirmed, "The customer hasn't confirmed the address details yet, see address_details."},
+	{codeInvalidUri, "The scanned code isn't an address or a valid monero: URI, or asks for something unsupported."},
+	{codeOpenAliasFailed, "The scanned OpenAlias couldn't be resolved to a single XMR address."},
+	{codeOpenAliasInsecure, "The scanned OpenAlias isn't DNSSEC validated and the operator requires it."},
+	{codeAddressBlocked, "The operator's address list refuses the scanned address, see address_flagged."},
+	{codeUnknownCurrency, "The bill acceptor reported a currency that isn't configured or has no known exponent."},
+	{codeCurrencyNotAllowed, "The note's currency can't be mixed with the cash inserted before."},
+	{codeLimitExceeded, "The cash exceeds a per-transaction or rolling per-address limit. A note over the limit is credited, but the payout is refused until the transaction is cancelled."},
+	{codeBelowMinimum, "The payout is below the minimum, more cash is needed."},
+	{codePayoutRefused, "MoneroPay refused the transfer. It may be retried."},
+	{codePayoutNotFound, "The transfer isn't in the wallet. It may be retried."},
+	{codeWalletUnconfigured, "Payout can't be reconciled without wallet RPC."},
+	{codeWalletUnavailable, "Wallet RPC couldn't be reached for reconciliation."},
+	{codeTransferNotFoundYet, "The transfer may still be in progress."},
+}
+
+// Error carrying a code for the frontend.
+type protocolError struct {
+	code string
+	msg  string
+}
+
+func (e *protocolError) Error() string {
+	return e.msg
+}
+
+func newProtocolError(code, format string, a ...interface{}) *protocolError {
+	return &protocolError{code: code, msg: fmt.Sprintf(format, a...)}
+}
+
+func errorCode(err error) string {
+	var pe *protocolError
+	if errors.As(err, &pe) {
+		return pe.code
+	}
+	return codeInternal
+}
+
+type helloData struct {
+	Version int    `json:"version"`
+	Kiosk   string `json:"kiosk,omitempty"`
+	// A transaction is in progress, the frontend should resume it.
+	InProgress bool `json:"in_progress"`
+	// New transactions are refused until prices are available again.
+	PriceUnavailable bool `json:"price_unavailable"`
+}
+
+type errorData struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type eventSpec struct {
+	Name        string
+	Description string
+	// Zero value of the payload, nil if the event has none
+	Payload interface{}
+}
+
+var frontendEventSpecs = []eventSpec{
+	{evStart, "Begin a new transaction by tapping the screen.", nil},
+	{evMoneyin, "Proceed to inserting cash once an address is scanned.", nil},
+	{evTxinfo, "Pay out the inserted cash. Repeating it retries a failed payout.", nil},
+	{evConfirmAddress, "The customer checked the address details and confirms them.", nil},
+	{evCancel, "Abort the transaction.", nil},
+	{evFinal, "Acknowledge the end of a finished transaction.", nil},
+	{evResume, "Reattach to the transaction in progress after a reconnect.", resumeRequest{}},
+}
+
+var backendEventSpecs = []eventSpec{
+	{eventHello, "Sent first on every connection.", helloData{}},
+	{eventSession, "A transaction began. Keep the token to resume it after a reload.", sessionTokenData{}},
+	{eventState, "Snapshot of the transaction in progress, the reply to resume.", stateData{}},
+	{eventQuote, "Price locked in for the transaction, with its expiry.", quote{}},
+	{eventQuoteExpired, "The quote expired and needs the customer's confirmation.", quoteExpiredData{}},
+	{eventPrice, "Current XMR prices, sent periodically while idle.", priceUpdate{}},
+	{eventPriceUnavailable, "No usable price, new transactions are refused until price_available.", nil},
+	{eventPriceAvailable, "Prices are available again after price_unavailable.", nil},
+	{eventMpayHealth, "Whether MoneroPay is healthy, sent periodically while idle.", false},
+	{eventAddressin, "An address was scanned.", ""},
+	{eventAddressDetails, "Details of the scanned address, sent after addressin. With needs_confirmation the customer must confirm them with confirm_address before inserting cash or paying out.", addressDetails{}},
+	{eventAddressFlagged, "The scanned address matched the operator's address list. It's refused, or with the warn action shown as a warning in address_details for the customer to confirm.", addressFlaggedData{}},
+	{eventMoneyin, "Cash was inserted. Amounts are in minor units of the currency.", moneyinData{}},
+	{eventSummary, "Per-currency breakdown of fees and the payout, sent as cash is inserted and before the payout.", payoutSummary{}},
+	{eventLimitReached, "A limit on inserted cash wouldn't fit the largest note anymore, the bill acceptor takes no more of the currency. Sent once until the limit allows notes again.", limitState{}},
+	{eventBelowMinimum, "The payout was refused as too small. Insert the amount of any one currency to proceed.", belowMinimumData{}},
+	{eventTxinfo, "XMR was sent, the transaction is done.", txinfoData{}},
+	{eventAck, "The frontend message with the echoed ID was accepted.", ackData{}},
+	{eventNack, "The frontend message with the echoed ID was refused.", nackData{}},
+	{eventError, "Something went wrong outside a state transition.", errorData{}},
+	{eventRejected, "A hardware event was refused.", rejectedData{}},
+	{eventResumed, "A transaction interrupted by a restart was resumed.", resumedData{}},
+	{eventPayoutPending, "The payout is being sent.", payoutEventData{}},
+	{eventPayoutSent, "A payout with unclear outcome was found in the wallet.", payoutEventData{}},
+	{eventPayoutFailed, "The payout wasn't sent and may be retried.", payoutEventData{}},
+	{eventPayoutUnknown, "It isn't known yet whether the payout was sent.", payoutEventData{}},
+}
+
+// Refuse frontends that only speak protocol versions we don't.
+func checkSubprotocol(w http.ResponseWriter, r *http.Request) bool {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 {
+		return true
+	}
+	for _, p := range requested {
+		for _, sp := range supportedSubprotocols {
+			if p == sp {
+				return true
+			}
+		}
+	}
+	http.Error(w, "unsupported protocol version", http.StatusBadRequest)
+	return false
+}
+
+func (s *sessionData) sendError(err error) {
+	if err := s.sendToFrontend(update{Event: eventError, Data: errorData{
+		Code:    errorCode(err),
+		Message: err.Error(),
+	}}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// JSON Schema of a Go value as encoding/json would marshal it.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{"type": "null"}
+	}
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchema(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+func eventSchema(e eventSpec) map[string]interface{} {
+	props := map[string]interface{}{
+		"event":     map[string]interface{}{"const": e.Name},
+		"id":        map[string]interface{}{"type": "string"},
+		"timestamp": jsonSchema(timeType),
+	}
+	required := []string{"event"}
+	if e.Payload != nil {
+		props["value"] = jsonSchema(reflect.TypeOf(e.Payload))
+		required = append(required, "value")
+	}
+	return map[string]interface{}{
+		"description": e.Description,
+		"type":        "object",
+		"properties":  props,
+		"required":    required,
+	}
+}
+
+func protocolSchema() map[string]interface{} {
+	var in, out []interface{}
+	for _, e := range frontendEventSpecs {
+		in = append(in, eventSchema(e))
+	}
+	for _, e := range backendEventSpecs {
+		out = append(out, eventSchema(e))
+	}
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   fmt.Sprintf("ATM backend websocket protocol v%d", protocolVersion),
+		"$defs": map[string]interface{}{
+			"frontend": map[string]interface{}{"oneOf": in},
+			"backend":  map[string]interface{}{"oneOf": out},
+		},
+	}
+}
+
+func writeProtocolDoc(w io.Writer) error {
+	fmt.Fprintf(w, "# ATM backend websocket protocol v%d\n\n", protocolVersion)
+	fmt.Fprintln(w, "<!-- Generated by `go generate`, do not edit. -->")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Connect to `/ws` requesting the `%s` websocket subprotocol. ", supportedSubprotocols[0])
+	fmt.Fprintln(w, "Every message is a JSON object with an `event` name, an optional `value` payload and a `timestamp`.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Frontend messages may carry an `id`. The backend answers each one with `ack` or `nack`, and every reply to it echoes the `id`.")
+
+	sections := []struct {
+		title  string
+		events []eventSpec
+	}{
+		{"Frontend to backend", frontendEventSpecs},
+		{"Backend to frontend", backendEventSpecs},
+	}
+	for _, sec := range sections {
+		fmt.Fprintf(w, "\n## %s\n", sec.title)
+		for _, e := range sec.events {
+			fmt.Fprintf(w, "\n### `%s`\n\n%s\n", e.Name, e.Description)
+			if e.Payload == nil {
+				continue
+			}
+			b, err := json.MarshalIndent(jsonSchema(reflect.TypeOf(e.Payload)), "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "\n```json\n%s\n```\n", b)
+		}
+	}
+
+	fmt.Fprintln(w, "\n## Error codes")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "| Code | Meaning |")
+	fmt.Fprintln(w, "| --- | --- |")
+	for _, c := range errorCodes {
+		fmt.Fprintf(w, "| `%s` | %s |\n", c.Code, c.Description)
+	}
+	return nil
+}
+
+// Print the protocol schema or documentation, see the go:generate lines in
+// protocol.go.
+func protocolCommand(args []string) {
+	if len(args) == 1 && args[0] == "schema" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(protocolSchema()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) == 1 && args[0] == "doc" {
+		if err := writeProtocolDoc(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Usage: ./atm-backend protocol schema|doc")
+	os.Exit(1)
+}
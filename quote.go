@@ -0,0 +1,102 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// What happens when a transaction outlives its quote
+const (
+	// Quote again at the current price
+	quoteRequote = "requote"
+	// Pay out at the expired quote anyway
+	quoteHonor = "honor"
+	// Quote again and have the customer confirm the new price
+	quoteConfirm = "confirm"
+)
+
+// Price locked in for a transaction. Rates are market prices, the fees are
+// charged on the inserted cash.
+type quote struct {
+	Id    string             `json:"id"`
+	Rates map[string]float64 `json:"rates"`
+	// Fee schedule in effect, empty for the defaults
+	FeeSchedule string                 `json:"fee_schedule,omitempty"`
+	Fees        map[string]currencyFee `json:"fees"`
+	// How each rate was found
+	Paths     map[string]pricePath `json:"paths"`
+	Source    string               `json:"source"`
+	CreatedAt time.Time            `json:"created_at"`
+	ExpiresAt time.Time            `json:"expires_at"`
+}
+
+type quoteExpiredData struct {
+	Expired *quote `json:"expired"`
+	Quote   *quote `json:"quote"`
+}
+
+func (q *quote) expired() bool {
+	return time.Now().After(q.ExpiresAt)
+}
+
+// Lock in the current prices and tell the frontend. Fails when no price is
+// known yet.
+func (s *sessionData) requote() error {
+	if len(s.xmrPrices) == 0 || s.lastPrice == nil {
+		return newProtocolError(codeNoPrice, "no price available")
+	}
+	if err := s.lastPrice.usable(); err != nil {
+		return err
+	}
+	now := time.Now()
+	q := &quote{
+		Id:        newSessionId(),
+		Rates:     make(map[string]float64),
+		Source:    s.lastPrice.Source,
+		CreatedAt: now,
+		ExpiresAt: now.Add(cfg.QuoteTtl),
+	}
+	q.Paths = make(map[string]pricePath)
+	for _, pc := range s.lastPrice.Currencies {
+		q.Rates[pc.Short] = pc.Market
+		q.Paths[pc.Short] = pc.Path
+	}
+	q.FeeSchedule, q.Fees = cfg.Fees.resolve(now)
+	s.quote = q
+	journ.record(s.id, journalQuote, q)
+	if err := s.sendToFrontend(update{Event: eventQuote, Data: q}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+	return nil
+}
+
+// Make sure the transaction has a quote that may be paid out at, applying
+// the expiry policy.
+func (s *sessionData) ensureQuote() error {
+	if s.quote == nil {
+		return s.requote()
+	}
+	if !s.quote.expired() {
+		return nil
+	}
+	switch cfg.QuoteExpiryPolicy {
+	case quoteHonor:
+		log.Info().Str("quote", s.quote.Id).Msg("Honoring expired quote")
+		return nil
+	case quoteConfirm:
+		expired := s.quote
+		if err := s.requote(); err != nil {
+			return err
+		}
+		if err := s.sendToFrontend(update{Event: eventQuoteExpired, Data: quoteExpiredData{
+			Expired: expired,
+			Quote:   s.quote,
+		}}); err != nil {
+			log.Error().Err(err).Msg("Failed to send to frontend")
+		}
+		return newProtocolError(codeQuoteExpired, "quote expired, confirm the new one")
+	default:
+		return s.requote()
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gitlab.com/moneropay/go-monero/walletrpc"
+)
+
+type sessionTokenData struct {
+	Token string `json:"token"`
+}
+
+type resumeRequest struct {
+	Token string `json:"token"`
+}
+
+// Everything the frontend needs to redraw an in-progress transaction.
+type stateData struct {
+	State       string           `json:"state"`
+	Address     string           `json:"address,omitempty"`
+	Destination *addressDetails  `json:"destination,omitempty"`
+	FiatBalance map[string]int64 `json:"fiat_balance"`
+	Xmr         string           `json:"xmr"`
+	Price       *priceUpdate     `json:"price,omitempty"`
+	MpayHealth  *bool            `json:"mpay_health,omitempty"`
+	Payout      *payoutEventData `json:"payout,omitempty"`
+	Quote       *quote           `json:"quote,omitempty"`
+	Summary     *payoutSummary   `json:"summary,omitempty"`
+	// Decimal balances for display
+	FiatDisplay map[string]string `json:"fiat_display"`
+}
+
+func (s *sessionData) sendSessionToken() {
+	if err := s.sendToFrontend(update{Event: eventSession, Data: sessionTokenData{
+		Token: s.token,
+	}}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+}
+
+// Say hello ahead of whatever was queued while no frontend was attached.
+func (s *sessionData) greet() {
+	b, err := json.Marshal(update{Event: eventHello, Timestamp: time.Now(), Data: helloData{
+		Version:          protocolVersion,
+		Kiosk:            s.kiosk,
+		InProgress:       s.state != Idle,
+		PriceUnavailable: s.priceUnavailable,
+	}})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+		return
+	}
+	s.out.unpop(b)
+}
+
+func (s *sessionData) snapshot() stateData {
+	sd := stateData{
+		State:       s.state.String(),
+		Address:     s.address,
+		Destination: s.destination,
+		FiatBalance: s.fiatBalance,
+		// Zero until the transaction has a quote
+		Xmr:         walletrpc.XMRToDecimal(0),
+		Price:       s.lastPrice,
+		MpayHealth:  s.lastHealth,
+		Quote:       s.quote,
+		FiatDisplay: formatBalance(s.fiatBalance),
+	}
+	if summary, err := s.summarize(); err == nil {
+		sd.Xmr = summary.Xmr
+		sd.Summary = summary
+	}
+	if s.summary != nil {
+		sd.Summary = s.summary
+	}
+	if s.payout != nil {
+		p := s.payout.eventData()
+		sd.Payout = &p
+	}
+	return sd
+}
+
+// Reattach a reloaded frontend to the transaction it was showing.
+func (s *sessionData) resume(front update) {
+	var req resumeRequest
+	b, err := json.Marshal(front.Data)
+	if err == nil {
+		err = json.Unmarshal(b, &req)
+	}
+	if err != nil {
+		s.nack(front, newProtocolError(codeMalformedMessage, "malformed resume request"))
+		return
+	}
+	if s.token == "" {
+		s.nack(front, newProtocolError(codeNoSession, "no transaction in progress"))
+		return
+	}
+	if req.Token != s.token {
+		s.nack(front, newProtocolError(codeInvalidToken, "invalid session token"))
+		return
+	}
+	s.ack(front)
+	if err := s.sendToFrontend(update{Event: eventState, Data: s.snapshot()}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+	log.Info().Str("kiosk", s.kiosk).Str("session", s.id).Msg("Frontend resumed transaction")
+}
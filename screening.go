@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Address list modes
+const (
+	// Listed addresses are flagged
+	screeningDeny = "deny"
+	// Addresses not listed are flagged
+	screeningAllow = "allow"
+)
+
+// What happens to a flagged address
+const (
+	screeningReject = "reject"
+	// Accepted once the customer confirms the warning
+	screeningWarn = "warn"
+)
+
+// A scanned address matched the screening list, see the address_list option
+type addressFlaggedData struct {
+	Address string `json:"address"`
+	Mode    string `json:"mode"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+}
+
+type auditScreeningData struct {
+	Kiosk   string `json:"kiosk,omitempty"`
+	Address string `json:"address"`
+	Mode    string `json:"mode"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+}
+
+// Operator-managed list of addresses with the reason they're listed,
+// reloaded when the file changes
+type addressList struct {
+	mu      sync.RWMutex
+	entries map[string]string
+	modTime time.Time
+	size    int64
+}
+
+var screening addressList
+
+// Read the list: an address per line, optionally followed by the reason.
+// Empty lines and lines starting with # are skipped.
+func (l *addressList) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		address := strings.Fields(line)[0]
+		entries[address] = strings.TrimSpace(line[len(address):])
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = entries
+	l.modTime = fi.ModTime()
+	l.size = fi.Size()
+	log.Info().Str("path", path).Int("addresses", len(entries)).Msg("Loaded address list")
+	return nil
+}
+
+func (l *addressList) changed(fi os.FileInfo) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return !fi.ModTime().Equal(l.modTime) || fi.Size() != l.size
+}
+
+// Reload the list whenever the file changes. A list that fails to load
+// keeps the previous one in effect.
+func watchAddressList(path string) {
+	for {
+		<-time.After(cfg.AddressListReload)
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Failed to check address list")
+			continue
+		}
+		if !screening.changed(fi) {
+			continue
+		}
+		if err := screening.load(path); err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Failed to reload address list")
+		}
+	}
+}
+
+// Whether the address is listed. An integrated address is also listed
+// through its standard address.
+func (l *addressList) lookup(a *moneroAddress) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if reason, ok := l.entries[a.Address]; ok {
+		return reason, true
+	}
+	if a.Kind == addressIntegrated {
+		reason, ok := l.entries[a.standard()]
+		return reason, ok
+	}
+	return "", false
+}
+
+// Screen a scanned address against the list. Rejected addresses are refused
+// with an error, otherwise the returned flag, if any, is a warning for the
+// customer to confirm.
+func (s *sessionData) screenAddress(a *moneroAddress) (*addressFlaggedData, error) {
+	if cfg.AddressList == "" {
+		return nil, nil
+	}
+	reason, listed := screening.lookup(a)
+	if listed == (cfg.AddressListMode == screeningAllow) {
+		return nil, nil
+	}
+	if reason == "" {
+		reason = "listed"
+		if cfg.AddressListMode == screeningAllow {
+			reason = "not on the allowlist"
+		}
+	}
+	flag := &addressFlaggedData{
+		Address: a.Address,
+		Mode:    cfg.AddressListMode,
+		Action:  cfg.AddressListAction,
+		Reason:  reason,
+	}
+	auditLog.record(s.id, auditScreening, auditScreeningData{
+		Kiosk:   s.kiosk,
+		Address: a.Address,
+		Mode:    flag.Mode,
+		Action:  flag.Action,
+		Reason:  flag.Reason,
+	})
+	log.Warn().Str("address", a.Address).Str("reason", reason).Str("action", flag.Action).
+		Msg("Address flagged by screening")
+	if err := s.sendToFrontend(update{Event: eventAddressFlagged, Data: flag}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+	if flag.Action == screeningReject {
+		return nil, newProtocolError(codeAddressBlocked, "address refused: %s", reason)
+	}
+	return flag, nil
+}
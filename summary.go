@@ -0,0 +1,164 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+	"gitlab.com/monero-atm/atm-backend/money"
+	"gitlab.com/moneropay/go-monero/walletrpc"
+)
+
+// Cash of one currency and what it's worth at the quoted price
+type lineItem struct {
+	Currency string  `json:"currency"`
+	Amount   int64   `json:"amount"`
+	Display  string  `json:"display"`
+	Price    float64 `json:"price"`
+	// ATM fee in minor units
+	Fee        int64   `json:"fee"`
+	FeeDisplay string  `json:"fee_display"`
+	FeePercent float64 `json:"fee_percent"`
+	// Cash converted after the fee
+	Net        int64  `json:"net"`
+	NetDisplay string `json:"net_display"`
+	// Rounded down for display, the total is rounded once over the exact sum.
+	Xmr string `json:"xmr"`
+}
+
+// Breakdown of a payout, sent before it's executed and again with txinfo
+type payoutSummary struct {
+	Quote       string     `json:"quote"`
+	FeeSchedule string     `json:"fee_schedule,omitempty"`
+	Items       []lineItem `json:"items"`
+	// Piconero the cash is worth
+	Gross uint64 `json:"gross"`
+	// Estimated network fee in piconero
+	NetworkFee uint64 `json:"network_fee"`
+	// Whether the network fee is deducted from the payout
+	NetworkFeeDeducted bool `json:"network_fee_deducted"`
+	// Piconero actually paid out
+	Total uint64 `json:"total"`
+	// Total in XMR for display
+	Xmr string `json:"xmr"`
+	// Progress toward the amount a scanned URI asked for
+	Target *targetGuidance `json:"target,omitempty"`
+}
+
+// Cash still needed to reach the target, per currency the customer may
+// insert. Inserting the amount of any one currency is enough.
+type targetGuidance struct {
+	Xmr     string `json:"xmr"`
+	Reached bool   `json:"reached"`
+	// Minor units
+	More map[string]int64 `json:"more"`
+	// Decimal amounts for display
+	Display map[string]string `json:"display"`
+}
+
+// Convert the balance at the quoted prices after fees. The sum is exact and
+// rounded once.
+func (s *sessionData) summarize() (*payoutSummary, error) {
+	if s.quote == nil {
+		return nil, newProtocolError(codeNoPrice, "no quote")
+	}
+	ps := &payoutSummary{Quote: s.quote.Id, FeeSchedule: s.quote.FeeSchedule, Items: []lineItem{}}
+	currencies := make([]string, 0, len(s.fiatBalance))
+	for c := range s.fiatBalance {
+		currencies = append(currencies, c)
+	}
+	sort.Strings(currencies)
+
+	sum := new(big.Rat)
+	for _, c := range currencies {
+		balance := s.fiatBalance[c]
+		price, err := money.Price(s.quote.Rates[c])
+		if err != nil {
+			return nil, newProtocolError(codeNoPrice, "no price for %s", c)
+		}
+		cf := s.quote.Fees[c]
+		fee := cf.fee(balance)
+		net := balance - fee
+		xmr, err := money.Xmr(fiat(c, net), price)
+		if err != nil {
+			return nil, err
+		}
+		sum.Add(sum, xmr)
+		pico, err := money.Piconero(xmr, money.RoundDown)
+		if err != nil {
+			return nil, err
+		}
+		ps.Items = append(ps.Items, lineItem{
+			Currency:   c,
+			Amount:     balance,
+			Display:    formatFiat(c, balance),
+			Price:      s.quote.Rates[c],
+			Fee:        fee,
+			FeeDisplay: formatFiat(c, fee),
+			FeePercent: cf.percent(balance),
+			Net:        net,
+			NetDisplay: formatFiat(c, net),
+			Xmr:        walletrpc.XMRToDecimal(pico),
+		})
+	}
+	gross, err := money.Piconero(sum, cfg.Rounding)
+	if err != nil {
+		return nil, err
+	}
+	ps.Gross = gross
+	ps.Total = gross
+	if s.networkFee != nil {
+		ps.NetworkFee = *s.networkFee
+		if cfg.NetworkFeePolicy == networkFeeDeduct {
+			ps.NetworkFeeDeducted = true
+			if ps.NetworkFee < ps.Total {
+				ps.Total -= ps.NetworkFee
+			} else {
+				ps.Total = 0
+			}
+		}
+	}
+	ps.Xmr = walletrpc.XMRToDecimal(ps.Total)
+	if target := s.target(); target > 0 {
+		if ps.Target, err = s.guideToward(target, ps.Total); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+func (s *sessionData) guideToward(target, total uint64) (*targetGuidance, error) {
+	tg := &targetGuidance{
+		Xmr:     walletrpc.XMRToDecimal(target),
+		Reached: total >= target,
+		More:    make(map[string]int64),
+		Display: make(map[string]string),
+	}
+	if tg.Reached {
+		return tg, nil
+	}
+	missing := money.FromPiconero(target - total)
+	for _, c := range cfg.Currencies {
+		if s.allowCurrency(c) != nil {
+			continue
+		}
+		more, err := s.cashFor(c, missing)
+		if err != nil {
+			return nil, err
+		}
+		tg.More[c] = more
+		tg.Display[c] = formatFiat(c, more)
+	}
+	return tg, nil
+}
+
+// Show the breakdown while cash is inserted, before the customer confirms.
+func (s *sessionData) sendSummary() {
+	summary, err := s.summarize()
+	if err != nil {
+		return
+	}
+	if err := s.sendToFrontend(update{Event: eventSummary, Data: summary}); err != nil {
+		log.Error().Err(err).Msg("Failed to send to frontend")
+	}
+}
@@ -1,31 +1,127 @@
 package main
 
 import (
-	"fmt"
+	"cmp"
+	"encoding/hex"
+	"net/url"
 	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gitlab.com/monero-atm/atm-backend/money"
 )
 
-func parseAddress(addr string) string {
-	_, addressWithParams, found0 := strings.Cut(addr, ":")
-	if !found0 {
-		return addr
+const moneroUriScheme = "monero:"
+
+// Scanned payment request, see
+// https://github.com/monero-project/monero/wiki/URI-Formatting
+type moneroUri struct {
+	Address string
+	// Piconero, zero when not requested
+	Amount        uint64
+	PaymentId     string
+	RecipientName string
+	Description   string
+	// Set when resolved from an OpenAlias
+	OpenAlias *openAliasInfo
+}
+
+// Parse a scanned code, either a bare address or a monero: URI.
+func parseMoneroUri(s string) (*moneroUri, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < len(moneroUriScheme) || !strings.EqualFold(s[:len(moneroUriScheme)], moneroUriScheme) {
+		if strings.Contains(s, ":") {
+			return nil, newProtocolError(codeInvalidUri, "not a monero: URI")
+		}
+		return &moneroUri{Address: s}, nil
+	}
+	// Some wallets write monero://
+	rest := strings.TrimPrefix(s[len(moneroUriScheme):], "//")
+	address, query, _ := strings.Cut(rest, "?")
+	if strings.Contains(address, ";") {
+		return nil, newProtocolError(codeInvalidUri, "payments to several recipients aren't supported")
+	}
+	u := &moneroUri{Address: address}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, newProtocolError(codeInvalidUri, "malformed URI parameters: %s", err)
 	}
-	address, _, found1 := strings.Cut(addressWithParams, "?")
-	if !found1 {
-		return addressWithParams
+	for key, values := range params {
+		if len(values) > 1 {
+			return nil, newProtocolError(codeInvalidUri, "parameter %s is repeated", key)
+		}
+		v := values[0]
+		switch key {
+		case "tx_amount":
+			if u.Amount, err = parseUriAmount(v); err != nil {
+				return nil, err
+			}
+		case "tx_payment_id":
+			u.PaymentId = strings.ToLower(v)
+		case "recipient_name":
+			u.RecipientName = v
+		case "tx_description":
+			u.Description = v
+		default:
+			// Wallets ignore what they don't know, so do we.
+			log.Warn().Str("parameter", key).Msg("Ignoring unknown URI parameter")
+		}
 	}
-	return address
+	return u, nil
 }
 
-func addressValidator(s string) error {
-	if len(s) != 95 {
-		return fmt.Errorf("invalid address length")
+// Decimal XMR amount of tx_amount
+func parseUriAmount(v string) (uint64, error) {
+	whole, frac, _ := strings.Cut(v, ".")
+	if whole == "" && frac == "" || strings.Trim(whole+frac, "0123456789") != "" {
+		return 0, newProtocolError(codeInvalidUri, "invalid tx_amount %q", v)
+	}
+	if len(frac) > 12 {
+		return 0, newProtocolError(codeInvalidUri, "tx_amount %q has more than 12 decimals", v)
+	}
+	amount, err := money.ParseXmr(v)
+	if err != nil || amount == 0 {
+		return 0, newProtocolError(codeInvalidUri, "invalid tx_amount %q", v)
+	}
+	return amount, nil
+}
+
+// Validate the URI's address, resolving it first if it's an OpenAlias. A
+// short payment ID is folded into an integrated address, since that's how
+// wallets send them nowadays.
+func (u *moneroUri) destination() (*moneroAddress, error) {
+	if name, ok := openAliasName(u.Address); ok {
+		resolved, err := resolveOpenAlias(name)
+		if err != nil {
+			return nil, err
+		}
+		if u.PaymentId != "" && resolved.PaymentId != "" && u.PaymentId != resolved.PaymentId {
+			return nil, newProtocolError(codeInvalidUri, "tx_payment_id conflicts with the OpenAlias record")
+		}
+		u.Address = resolved.Address
+		u.OpenAlias = resolved.OpenAlias
+		u.PaymentId = cmp.Or(u.PaymentId, resolved.PaymentId)
+		u.RecipientName = cmp.Or(u.RecipientName, resolved.RecipientName)
+		u.Description = cmp.Or(u.Description, resolved.Description)
+	}
+	a, err := addressValidator(u.Address)
+	if err != nil {
+		return nil, err
+	}
+	if u.PaymentId == "" {
+		return a, nil
 	}
-	if cfg.Mode == "mainnet" && !(s[0] == '8' || s[0] == '4') {
-		return fmt.Errorf("invalid mainnet address")
+	pid, err := hex.DecodeString(u.PaymentId)
+	if err != nil {
+		return nil, newProtocolError(codeInvalidUri, "invalid tx_payment_id")
 	}
-	if cfg.Mode == "stagenet" && !(s[0] == '7' || s[0] == '5') {
-		return fmt.Errorf("invalid stagenet address")
+	switch {
+	case len(pid) == 32:
+		return nil, newProtocolError(codeInvalidUri, "long payment IDs aren't supported, use an integrated address")
+	case len(pid) != paymentIdLen:
+		return nil, newProtocolError(codeInvalidUri, "invalid tx_payment_id length")
+	case a.Kind != addressStandard:
+		return nil, newProtocolError(codeInvalidUri, "tx_payment_id can't be used with a %s address", a.Kind)
 	}
-	return nil
+	return a.integrate(pid), nil
 }